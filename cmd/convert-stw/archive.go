@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bcl/convert-stw/stw"
+)
+
+/* convertArchive converts every STWriter file in a .zip or .tar archive into outDir */
+func convertArchive(archive, outDir string) error {
+	batchFile = archive
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") {
+		return convertZip(archive, outDir)
+	}
+	if strings.HasSuffix(strings.ToLower(archive), ".tar") {
+		return convertTar(archive, outDir)
+	}
+	return fmt.Errorf("ERROR: %s is not a .zip or .tar archive", archive)
+}
+
+// maxMemberSize is the most an archive member is read of when there is no -max-bytes, so a small archive cannot unpack into an unbounded amount of data
+const maxMemberSize = 64 << 20
+
+// memberSniffSize is how far into a member the STWriter header is looked for, the same prefix Parse looks in unless -scan-for-header is set
+const memberSniffSize = 4096
+
+// errNotSTWriter is returned by convertMember for a member without the STWriter header, it is skipped
+var errNotSTWriter = errors.New("not a STWriter file")
+
+// memberCount - Counts the archive members that were converted and the ones that failed, which are reported and skipped
+type memberCount struct {
+	converted int
+	failed    int
+}
+
+/* convert converts one member, reporting its problem and carrying on when it cannot be converted */
+func (c *memberCount) convert(name string, r io.Reader, outDir string) {
+	err := convertMember(name, r, outDir)
+	if err == errNotSTWriter {
+		info("Skipping %s, not a STWriter file", name)
+		return
+	}
+	if err != nil {
+		warning(fmt.Errorf("ERROR: %s: %s", name, err))
+		c.failed = c.failed + 1
+		return
+	}
+	c.converted = c.converted + 1
+}
+
+/* err returns an error when any of the members could not be converted */
+func (c *memberCount) err() error {
+	if c.failed > 0 {
+		return fmt.Errorf("ERROR: %d of %d archive members could not be converted", c.failed, c.failed+c.converted)
+	}
+	return nil
+}
+
+/* convertZip converts the STWriter members of a zip archive */
+func convertZip(archive, outDir string) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	var count memberCount
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			warning(fmt.Errorf("ERROR: %s: %s", f.Name, err))
+			count.failed = count.failed + 1
+			continue
+		}
+		count.convert(f.Name, rc, outDir)
+		rc.Close()
+	}
+	return count.err()
+}
+
+/* convertTar converts the STWriter members of a tar archive, it stops at a problem with the archive itself since the members after it cannot be found */
+func convertTar(archive, outDir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var count memberCount
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return count.err()
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		count.convert(hdr.Name, tr, outDir)
+	}
+}
+
+/* convertMember converts one archive member if it is a STWriter file, writing it under outDir, and removes the output when it fails */
+func convertMember(name string, r io.Reader, outDir string) error {
+	r, err := gunzip(r)
+	if err != nil {
+		return err
+	}
+	limit := int64(maxMemberSize)
+	if cfg.Parser.MaxBytes > 0 {
+		// Read one byte past the limit so Parse still stops with ErrTooLarge
+		limit = cfg.Parser.MaxBytes + 1
+	}
+	limited := &io.LimitedReader{R: r, N: limit}
+	member := bufio.NewReaderSize(limited, memberSniffSize)
+	if !cfg.Parser.ScanForHeader {
+		start, err := member.Peek(memberSniffSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		signature := cfg.Parser.Signature
+		if len(signature) == 0 {
+			signature = stw.Signature
+		}
+		if !bytes.Contains(start, signature) {
+			return errNotSTWriter
+		}
+	}
+
+	// Keep the archive's directories, but never write outside of outDir
+	name = filepath.Clean(filepath.FromSlash(trimGzipExt(name)))
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("ERROR: archive member %s is outside of the archive", name)
+	}
+	outPath := filepath.Join(outDir, strings.TrimSuffix(name, filepath.Ext(name))+outputExt())
+	if err = os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return err
+	}
+
+	info("Converting %s to %s", name, outPath)
+	fout, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	err = convertFile(member, fout)
+	if err == nil && limited.N == 0 && cfg.Parser.MaxBytes == 0 {
+		err = fmt.Errorf("ERROR: %s is larger than %d bytes", name, maxMemberSize)
+	}
+	if errors.Is(err, stw.ErrNoHeader) {
+		// -scan-for-header did not find it anywhere in the member
+		err = errNotSTWriter
+	}
+	if err != nil {
+		// Don't leave an empty or partial file behind
+		fout.Close()
+		os.Remove(outPath)
+		return err
+	}
+	return fout.Close()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// chainOpener - Opens the files chained with Ctrl-V from the directory of the file that chains to them
+type chainOpener struct {
+	dir     string
+	visited map[string]bool
+}
+
+/* newChainOpener returns an opener for the chain that starts at path, which is empty for stdin */
+func newChainOpener(path string) *chainOpener {
+	c := &chainOpener{dir: ".", visited: map[string]bool{}}
+	if len(path) > 0 {
+		c.dir = filepath.Dir(path)
+		if abs, err := filepath.Abs(path); err == nil {
+			c.visited[abs] = true
+		}
+	}
+	return c
+}
+
+/* open opens a chained file, refusing the files that have already been converted */
+func (c *chainOpener) open(name string) (io.ReadCloser, error) {
+	// Drop the Atari device, eg. D1:PART2.DOC
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	path := filepath.Join(c.dir, strings.TrimSpace(name))
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// Atari filenames are uppercase, copies of them often are not
+		path = filepath.Join(c.dir, strings.ToLower(strings.TrimSpace(name)))
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.visited[abs] {
+		return nil, fmt.Errorf("%s has already been converted", path)
+	}
+	fin, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	c.visited[abs] = true
+	c.dir = filepath.Dir(path)
+	return fin, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bcl/convert-stw/stw"
+)
+
+/* countFile returns the pages of one document, which may be gzipped */
+func countFile(p *stw.Parser, fin io.Reader) (int, error) {
+	fin, err := gunzip(fin)
+	if err != nil {
+		return 0, err
+	}
+	return p.CountPages(fin)
+}
+
+/* countPages prints the pages of each input file, and their total when there is more than one */
+func countPages(paths []string) error {
+	p := cfg.Parser
+	p.OnParagraph = nil
+	if len(paths) == 0 {
+		pages, err := countFile(&p, os.Stdin)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("stdin: %d pages\n", pages)
+		return nil
+	}
+
+	total := 0
+	for _, path := range paths {
+		fin, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		if cfg.FollowChain {
+			p.FollowChain = newChainOpener(path).open
+		}
+		pages, err := countFile(&p, fin)
+		fin.Close()
+		if err != nil {
+			return fmt.Errorf("ERROR: %s: %s", path, err)
+		}
+		fmt.Printf("%s: %d pages\n", path, pages)
+		total = total + pages
+	}
+	if len(paths) > 1 {
+		fmt.Printf("Total: %d pages\n", total)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/bcl/convert-stw/stw"
+)
+
+/* markdownRuns splits a line of markdown into runs of text at the ** bold and * italic emphasis, a backslash escapes the character after it */
+func markdownRuns(text string, font *stw.FontType) []stw.Run {
+	var runs []stw.Run
+	var run []byte
+	flush := func() {
+		if len(run) > 0 {
+			runs = append(runs, stw.Run{Font: *font, Text: string(run)})
+			run = nil
+		}
+	}
+	toggle := func(emphasis stw.FontType) {
+		flush()
+		if *font == emphasis {
+			*font = stw.PicaFont
+		} else {
+			*font = emphasis
+		}
+	}
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\\' && i+1 < len(text):
+			i = i + 1
+			run = append(run, text[i])
+		case strings.HasPrefix(text[i:], "**"):
+			toggle(stw.BoldFont)
+			i = i + 1
+		case text[i] == '*':
+			toggle(stw.ItalicFont)
+		default:
+			run = append(run, text[i])
+		}
+	}
+	flush()
+	return runs
+}
+
+/* readMarkdown reads the paragraphs, # headings and emphasis of a markdown or plain text document, the lines of a paragraph are kept apart by line ends */
+func readMarkdown(fin io.Reader) (stw.Document, error) {
+	doc := stw.Document{Charset: cfg.Parser.Charset}
+	var para *stw.Paragraph
+	font := stw.PicaFont
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \r")
+		if len(line) == 0 {
+			para = nil
+			continue
+		}
+		level := len(line) - len(strings.TrimLeft(line, "#"))
+		if level > 0 && level < 10 && strings.HasPrefix(line[level:], " ") {
+			doc.Paragraphs = append(doc.Paragraphs, stw.Paragraph{Heading: level, Runs: markdownRuns(line[level+1:], &font)})
+			para = nil
+			continue
+		}
+		if para == nil {
+			doc.Paragraphs = append(doc.Paragraphs, stw.Paragraph{})
+			para = &doc.Paragraphs[len(doc.Paragraphs)-1]
+		} else {
+			para.Runs = append(para.Runs, stw.Run{Font: font, Text: "\n"})
+		}
+		para.Runs = append(para.Runs, markdownRuns(line, &font)...)
+	}
+	return doc, scanner.Err()
+}
+
+/* encodeMarkdown writes a markdown or plain text document as a STWriter document */
+func encodeMarkdown(fin io.Reader, fout io.Writer) error {
+	doc, err := readMarkdown(fin)
+	if err != nil {
+		return err
+	}
+	return stw.Encode(fout, doc)
+}
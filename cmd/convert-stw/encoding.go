@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+/* newEncodingWriter returns a writer that transcodes the UTF-8 output to the selected encoding */
+func newEncodingWriter(w io.Writer, encoding string, bom bool) (*utf16Writer, error) {
+	switch encoding {
+	case "utf16le":
+		return &utf16Writer{out: w, order: binary.LittleEndian, bom: bom}, nil
+	case "utf16be":
+		return &utf16Writer{out: w, order: binary.BigEndian, bom: bom}, nil
+	}
+	return nil, fmt.Errorf("ERROR: unknown output encoding %q", encoding)
+}
+
+// utf16Writer - Transcodes UTF-8 to UTF-16, bytes that are not valid UTF-8 are treated as Latin-1
+type utf16Writer struct {
+	out     io.Writer
+	order   binary.ByteOrder
+	bom     bool   // Write a byte order mark before the first character
+	pending []byte // Incomplete UTF-8 sequence from the end of the last Write
+}
+
+func (w *utf16Writer) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	var runes []rune
+	for len(w.pending) > 0 && utf8.FullRune(w.pending) {
+		r, size := utf8.DecodeRune(w.pending)
+		if r == utf8.RuneError && size == 1 {
+			r = rune(w.pending[0])
+		}
+		runes = append(runes, r)
+		w.pending = w.pending[size:]
+	}
+	if err := w.writeRunes(runes); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/* Flush writes out any incomplete UTF-8 sequence left at the end of the output */
+func (w *utf16Writer) Flush() error {
+	var runes []rune
+	for _, b := range w.pending {
+		runes = append(runes, rune(b))
+	}
+	w.pending = nil
+	return w.writeRunes(runes)
+}
+
+/* writeRunes encodes the runes as UTF-16 in the writer's byte order */
+func (w *utf16Writer) writeRunes(runes []rune) error {
+	if w.bom {
+		runes = append([]rune{'\uFEFF'}, runes...)
+		w.bom = false
+	}
+	units := utf16.Encode(runes)
+	buf := make([]byte, 2*len(units))
+	for i, u := range units {
+		w.order.PutUint16(buf[2*i:], u)
+	}
+	_, err := w.out.Write(buf)
+	return err
+}
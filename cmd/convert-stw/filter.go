@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// filterWriter - Passes each UTF-8 character of the output through a filter function
+type filterWriter struct {
+	out     io.Writer
+	filter  func(r rune, raw []byte) []byte // raw is the original bytes for r
+	pending []byte                          // Incomplete UTF-8 sequence from the end of the last Write
+}
+
+func (w *filterWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	var buf []byte
+	for len(w.pending) > 0 && utf8.FullRune(w.pending) {
+		r, size := utf8.DecodeRune(w.pending)
+		buf = append(buf, w.filter(r, w.pending[:size])...)
+		w.pending = w.pending[size:]
+	}
+	if _, err := w.out.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/* Flush passes any incomplete UTF-8 sequence left at the end of the output through the filter */
+func (w *filterWriter) Flush() error {
+	var buf []byte
+	for i := range w.pending {
+		buf = append(buf, w.filter(utf8.RuneError, w.pending[i:i+1])...)
+	}
+	w.pending = nil
+	_, err := w.out.Write(buf)
+	return err
+}
+
+// asciiFolds - Plain ASCII replacements for typographic punctuation
+var asciiFolds = map[rune]string{
+	'‘': "'", '’': "'", '‚': "'", '‛': "'",
+	'“': "\"", '”': "\"", '„': "\"", '‟': "\"",
+	'‐': "-", '‑': "-", '‒': "-", '–': "-", '—': "-", '―': "-",
+	'…': "...",
+}
+
+/* newASCIIFoldWriter folds smart quotes, dashes and ellipsis into plain ASCII */
+func newASCIIFoldWriter(w io.Writer) *filterWriter {
+	return &filterWriter{out: w, filter: func(r rune, raw []byte) []byte {
+		if fold, ok := asciiFolds[r]; ok && utf8.RuneLen(r) == len(raw) {
+			return []byte(fold)
+		}
+		return raw
+	}}
+}
+
+/* newStrictASCIIWriter replaces everything except tab, newline and printable 7-bit ASCII with sub */
+func newStrictASCIIWriter(w io.Writer, sub string, count *int) *filterWriter {
+	return &filterWriter{out: w, filter: func(r rune, raw []byte) []byte {
+		if len(raw) == 1 && (raw[0] == '\t' || raw[0] == '\n' || (raw[0] >= 0x20 && raw[0] <= 0x7e)) {
+			return raw
+		}
+		*count = *count + 1
+		return []byte(sub)
+	}}
+}
+
+// replaceRule - A text substitution from a -replace rules file
+type replaceRule struct {
+	from   []byte
+	to     []byte
+	regexp *regexp.Regexp // Set when the rules are regular expressions
+}
+
+/* readReplaceRules reads the from<TAB>to rules from a file, skipping blank and # comment lines */
+func readReplaceRules(path string, useRegexp bool) ([]replaceRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []replaceRule
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum = lineNum + 1
+		line := scanner.Text()
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 || len(fields[0]) == 0 {
+			return nil, fmt.Errorf("ERROR: %s line %d is not in the form from<TAB>to", path, lineNum)
+		}
+		rule := replaceRule{from: []byte(fields[0]), to: []byte(fields[1])}
+		if useRegexp {
+			if rule.regexp, err = regexp.Compile(fields[0]); err != nil {
+				return nil, fmt.Errorf("ERROR: %s line %d: %s", path, lineNum, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// replaceWriter - Applies the replace rules to each line of the output
+type replaceWriter struct {
+	out   io.Writer
+	rules []replaceRule
+	line  []byte // Output after the last newline
+}
+
+func (w *replaceWriter) Write(p []byte) (int, error) {
+	w.line = append(w.line, p...)
+	end := bytes.LastIndexByte(w.line, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+	var buf []byte
+	for _, line := range bytes.SplitAfter(w.line[:end+1], []byte("\n")) {
+		buf = append(buf, w.replace(line)...)
+	}
+	w.line = append([]byte(nil), w.line[end+1:]...)
+	if _, err := w.out.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/* Flush applies the rules to the last line of the output */
+func (w *replaceWriter) Flush() error {
+	_, err := w.out.Write(w.replace(w.line))
+	w.line = nil
+	return err
+}
+
+/* replace applies each of the rules, in order, to a line */
+func (w *replaceWriter) replace(line []byte) []byte {
+	for _, rule := range w.rules {
+		if rule.regexp != nil {
+			line = rule.regexp.ReplaceAll(line, rule.to)
+		} else {
+			line = bytes.Replace(line, rule.from, rule.to, -1)
+		}
+	}
+	return line
+}
+
+// eolWriter - Replaces each newline in the output with the -eol line ending
+type eolWriter struct {
+	out io.Writer
+	eol []byte
+}
+
+func (w *eolWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(bytes.Replace(p, []byte("\n"), w.eol, -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// lineEndings - The line endings for -eol
+var lineEndings = map[string]string{
+	"lf":   "\n",
+	"crlf": "\r\n",
+	"cr":   "\r",
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+/* gunzip returns a reader that decompresses the input when it starts with the gzip magic number, otherwise it reads the input as it is */
+func gunzip(fin io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(fin)
+	magic, err := buffered.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return buffered, nil
+	}
+	zr, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+/* trimGzipExt removes a .gz extension from a filename, so foo.doc.gz is converted to foo.txt */
+func trimGzipExt(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".gz") {
+		return name[:len(name)-3]
+	}
+	return name
+}
@@ -1,428 +1,792 @@
 package main
 
 import (
-	"bufio"
+	"compress/gzip"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/bcl/convert-stw/stw"
 )
 
 type cmdlineArgs struct {
-	SettingsOut bool // Output information about settings at the end
-	InFile      string
-	OutFile     string
+	SettingsOut       bool // Output information about settings at the end
+	StatsOut          bool // Output document statistics at the end
+	WarningsAreErrors bool // Exit with an error if any warnings were logged
+	Verbose           bool // Log each control code
+	Quiet             bool // Only log warnings and errors
+	InFile            string
+	OutFile           string
+	EncodingOut       string     // utf8, utf16le, or utf16be
+	BOM               bool       // Write a byte order mark at the start of UTF-16 output
+	EOL               string     // Line ending of the output, lf, crlf or cr
+	GzipOutput        bool       // Compress the output with gzip
+	DumpBytes         int        // Dump this many bytes from the start of the input instead of converting it
+	SettingsSchema    bool       // Output the JSON Schema of the settings instead of converting
+	Version           bool       // Output the version and exit
+	Validate          bool       // Parse the inputs without output and report the ones with problems
+	CountPages        bool       // Parse the inputs without output and print the pages they fill
+	Encode            bool       // Write a STWriter document from markdown or plain text instead of converting
+	Archive           string     // Convert the STWriter members of a .zip or .tar archive
+	InputGlob         string     // Convert the files matching a filepath.Glob pattern
+	OutputDir         string     // Directory for the output files of the inputs on the cmdline, the archive members and the glob matches
+	OutputExt         string     // Extension of the output files, written next to the inputs when there is no -output
+	ExportHeaders     string     // File to write the header active on each page to
+	ColumnOrder       string     // File to write the page, column and line of each laid out line to
+	ParagraphIndex    string     // File to write the page, line and text of each paragraph to
+	SplitPages        string     // Filename template to write each page to its own file with
+	SplitOn           string     // Where SplitPages starts the next file, page, eject, pagelength or heading
+	Trace             bool       // Write each control code to stderr as it is parsed
+	FollowChain       bool       // Carry on converting into the files chained with Ctrl-V
+	Annotations       string     // Also report batch warnings as CI annotations, only github for now
+	ReplaceFile       string     // File of from<TAB>to text substitutions
+	ReplaceRegexp     bool       // The ReplaceFile rules are regular expressions
+	ASCIIFold         bool       // Fold smart quotes, dashes and ellipsis into plain ASCII
+	StrictASCII       bool       // Only output tab, newline and printable 7-bit ASCII
+	WordFreq          bool       // Output a CSV of word frequencies instead of the document
+	WordFreqFold      bool       // Lowercase words and strip their punctuation for WordFreq
+	StrictASCIISub    string     // Replacement for characters removed by StrictASCII
+	EmbedProvenance   bool       // Write the source file, conversion time and tool version into the html head
+	Parser            stw.Parser // Converts the documents
 }
 
 var cfg = cmdlineArgs{
-	SettingsOut: false,
-	InFile:      "", // Use stdin if not set
-	OutFile:     "", // Use stdout if not set
+	SettingsOut:       false,
+	StatsOut:          false,
+	WarningsAreErrors: false,
+	Verbose:           false,
+	Quiet:             false,
+	InFile:            "", // Use stdin if not set
+	OutFile:           "", // Use stdout if not set
+	EncodingOut:       "utf8",
+	BOM:               false,
+	EOL:               "lf",
+	GzipOutput:        false,
+	DumpBytes:         0,
+	SettingsSchema:    false,
+	Version:           false,
+	Validate:          false,
+	CountPages:        false,
+	Encode:            false,
+	Archive:           "",
+	InputGlob:         "",
+	OutputDir:         "", // Next to the inputs, or the current directory for -archive and -input-glob
+	OutputExt:         "",
+	ExportHeaders:     "",
+	ColumnOrder:       "",
+	ParagraphIndex:    "",
+	SplitPages:        "",
+	SplitOn:           "page",
+	Trace:             false,
+	FollowChain:       false,
+	Annotations:       "",
+	ReplaceFile:       "",
+	ReplaceRegexp:     false,
+	ASCIIFold:         false,
+	StrictASCII:       false,
+	WordFreq:          false,
+	WordFreqFold:      false,
+	StrictASCIISub:    "?",
+	EmbedProvenance:   false,
+	Parser: stw.Parser{
+		Format:            "text",
+		Charset:           "raw",
+		CodeMap:           map[byte]string{},
+		FontMap:           map[int]int{},
+		LeadingBlankLines: "preserve",
+		FormFeed:          "none",
+		FlushInterval:     "none",
+	},
 }
 
-// FontType - Supported font types
-type FontType int
+// fontMap - Maps the font numbers used by a document to the standard ones, set with -map-font 3=2 or 3=condensed
+type fontMap map[int]int
 
-const (
-	picaFont FontType = iota
-	boldFont
-	condensedFont
-	italicFont
-	eliteFont
-)
+func (m fontMap) String() string {
+	var mappings []string
+	for from, to := range m {
+		mappings = append(mappings, fmt.Sprintf("%d=%d", from, to))
+	}
+	sort.Strings(mappings)
+	return strings.Join(mappings, ",")
+}
+
+func (m fontMap) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("%q is not in the form from=to", value)
+	}
+	from, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return fmt.Errorf("%q is not a valid font number", fields[0])
+	}
+	to, err := stw.ParseFontType(fields[1])
+	if err != nil {
+		return fmt.Errorf("%q is not a valid font name or number", fields[1])
+	}
+	m[from] = int(to)
+	return nil
+}
+
+// headerSignature - The STWriter header to look for, set with -header-signature using Go string escapes
+type headerSignature struct {
+	signature *[]byte
+}
+
+func (h headerSignature) String() string {
+	if h.signature == nil {
+		return ""
+	}
+	quoted := strconv.Quote(string(*h.signature))
+	return quoted[1 : len(quoted)-1]
+}
+
+func (h headerSignature) Set(value string) error {
+	signature, err := strconv.Unquote(`"` + strings.Replace(value, `"`, `\"`, -1) + `"`)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid signature", value)
+	}
+	if len(signature) == 0 {
+		return fmt.Errorf("the signature cannot be empty")
+	}
+	*h.signature = []byte(signature)
+	return nil
+}
+
+// warningCount is the number of warnings logged during the conversion
+var warningCount int
+
+// replaceRules are the text substitutions read from the -replace file
+var replaceRules []replaceRule
+
+// batchFile is the file being converted in batch mode, used for annotations
+var batchFile string
+
+// batchStdout is true when the batch of documents is concatenated to stdout, where annotations would end up in the text
+var batchStdout bool
+
+/* warning logs a problem that the conversion can continue past */
+func warning(err error) {
+	warningCount = warningCount + 1
+	log.Println(err)
+	if cfg.Annotations == "github" && len(batchFile) > 0 && !batchStdout {
+		fmt.Printf("::warning file=%s::%s\n", githubEscape(batchFile, true), githubEscape(err.Error(), false))
+	}
+}
+
+/* info logs a message about the conversion unless -q is set */
+func info(format string, args ...interface{}) {
+	if cfg.Parser.LogLevel >= stw.LogInfo {
+		log.Printf(format, args...)
+	}
+}
+
+/* githubEscape escapes a GitHub Actions workflow command message or property value */
+func githubEscape(s string, property bool) string {
+	s = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+	if property {
+		s = strings.NewReplacer(":", "%3A", ",", "%2C").Replace(s)
+	}
+	return s
+}
+
+// codeMap - Maps unknown control codes to replacement text, set with -map-code 0x1b=[ESC]
+type codeMap map[byte]string
 
-type documentSettings struct {
-	MarginTop        int
-	MarginBottom     int
-	MarginLeft       int
-	MarginRight      int
-	MarginLeft2      int
-	MarginRight2     int
-	PageLength       int
-	Indent           int
-	Font             FontType
-	HeaderCapture    bool
-	Header           []byte
-	FooterCapture    bool
-	Footer           []byte
-	Center           bool
-	BlockRight       bool
-	Justified        bool
-	StartPageNum     int
-	LineSpacing      int
-	ParagraphSpacing int
-	SectionLevel     int
-	ChainFile        []byte
+func (m codeMap) String() string {
+	var mappings []string
+	for code, text := range m {
+		mappings = append(mappings, fmt.Sprintf("0x%02x=%s", code, text))
+	}
+	sort.Strings(mappings)
+	return strings.Join(mappings, ",")
+}
+
+func (m codeMap) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("%q is not in the form code=text", value)
+	}
+	code, err := strconv.ParseUint(fields[0], 0, 8)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid byte value", fields[0])
+	}
+	m[byte(code)] = fields[1]
+	return nil
 }
 
-/* printDocumentSettings displays the document settings */
-func printDocumentSettings(settings *documentSettings) {
-	fmt.Println("\n\nDocument Settings\n=================")
-	fmt.Printf("Margins:\n    Top       : %d\n    Bottom    : %d\n    Left      : %d\n    Right     : %d\n\n",
-		settings.MarginTop, settings.MarginBottom, settings.MarginLeft, settings.MarginRight)
-	fmt.Printf("Column2:\n    Left      : %d\n    Right     : %d\n\n",
-		settings.MarginLeft2, settings.MarginRight2)
-	fmt.Printf("Page Length   : %d\n", settings.PageLength)
-	fmt.Printf("Starting Page : %d\n\n", settings.StartPageNum)
-	fmt.Printf("Header        : %s\n", settings.Header)
-	fmt.Printf("Footer        : %s\n\n", settings.Footer)
-	fmt.Println("Spacing")
-	fmt.Printf("    Line      : %d\n", settings.LineSpacing)
-	fmt.Printf("    Paragraph : %d\n\n", settings.ParagraphSpacing)
-	fmt.Printf("Chained file  : %s\n", settings.ChainFile)
+/* printDocumentSettings writes the document settings to w */
+func printDocumentSettings(w io.Writer, settings *stw.Settings) {
+	fmt.Fprint(w, "\n\n", settings.String())
+}
+
+/* printDocumentStats writes the paragraph, page, font and character counts to w */
+func printDocumentStats(w io.Writer, structure *stw.Structure) {
+	fmt.Fprintln(w, "\n\nStatistics\n==========")
+	fmt.Fprintf(w, "Paragraphs     : %d\n", structure.Paragraphs)
+	fmt.Fprintf(w, "Pages          : %d\n", structure.Pages)
+	fmt.Fprintf(w, "Page ejects    : %d\n", structure.PageEjects)
+	fmt.Fprintf(w, "Centered lines : %d\n", structure.CenteredLines)
+	fmt.Fprintf(w, "Characters     : %d\n\n", structure.ParagraphChars)
+
+	var fonts []int
+	for font := range structure.FontChanges {
+		fonts = append(fonts, int(font))
+	}
+	sort.Ints(fonts)
+	fmt.Fprintln(w, "Font changes")
+	for _, font := range fonts {
+		fmt.Fprintf(w, "    %-10s: %d\n", stw.FontType(font), structure.FontChanges[stw.FontType(font)])
+	}
 }
 
 /* parseArgs handles parsing the cmdline args and setting values in the global cfg struct */
 func parseArgs() {
 	flag.BoolVar(&cfg.SettingsOut, "settings", cfg.SettingsOut, "Output settings at the end")
+	flag.BoolVar(&cfg.StatsOut, "stats", cfg.StatsOut, "Output paragraph, page, font and character counts at the end")
+	flag.BoolVar(&cfg.Version, "version", cfg.Version, "Output the version, commit and build date and exit")
+	flag.BoolVar(&cfg.SettingsSchema, "print-settings-schema", cfg.SettingsSchema, "Output the JSON Schema for the settings and exit")
+	flag.BoolVar(&cfg.Parser.CheckLineWidth, "check-line-width", cfg.Parser.CheckLineWidth, "Warn about output lines with words wider than the margins")
+	flag.BoolVar(&cfg.Parser.NormalizeSpace, "normalize-space", cfg.Parser.NormalizeSpace, "Collapse runs of spaces in the text into one space")
+	flag.BoolVar(&cfg.Parser.StripCR, "strip-cr", cfg.Parser.StripCR, "Drop the stray CR and LF bytes that are not the start of a Ctrl-M or Ctrl-J setting")
+	flag.IntVar(&cfg.Parser.TabWidth, "tab-width", cfg.Parser.TabWidth, "Expand each tab in the text into N spaces, 0 keeps the tabs")
+	flag.BoolVar(&cfg.Validate, "validate", cfg.Validate, "Parse the input files without writing output and print OK or their errors")
+	flag.BoolVar(&cfg.CountPages, "count-pages", cfg.CountPages, "Print the pages each input file fills at its page length without converting it")
+	flag.BoolVar(&cfg.Encode, "encode", cfg.Encode, "Write a STWriter document from markdown or plain text input, the -charset is used for the characters above 0x7e")
+	flag.BoolVar(&cfg.Parser.RaggedNumbers, "ragged-numbers", cfg.Parser.RaggedNumbers, "Read the numbers after control codes up to the first non-digit instead of at a fixed width")
+	flag.BoolVar(&cfg.Parser.Strict, "strict", cfg.Parser.Strict, "Stop with an error at the first malformed control code")
+	flag.Int64Var(&cfg.Parser.MaxBytes, "max-bytes", cfg.Parser.MaxBytes, "Stop with an error after reading this much input, for untrusted files, 0 is no limit")
+	flag.BoolVar(&cfg.Verbose, "v", cfg.Verbose, "Verbose, also log each control code")
+	flag.BoolVar(&cfg.Quiet, "q", cfg.Quiet, "Quiet, only log warnings and errors")
+	flag.BoolVar(&cfg.Trace, "trace", cfg.Trace, "Write the offset, name and argument bytes of each control code to stderr, and the skipped bytes with -v")
+	flag.BoolVar(&cfg.WarningsAreErrors, "warnings-are-errors", cfg.WarningsAreErrors, "Exit with an error if there were any warnings")
 	flag.StringVar(&cfg.InFile, "input", cfg.InFile, "Input file (default stdin)")
 	flag.StringVar(&cfg.OutFile, "output", cfg.OutFile, "Output file (default stdout)")
+	flag.StringVar(&cfg.Archive, "archive", cfg.Archive, "Convert the STWriter files in a .zip or .tar archive")
+	flag.StringVar(&cfg.InputGlob, "input-glob", cfg.InputGlob, "Convert the files matching a pattern, eg. \"*.stw\"")
+	flag.StringVar(&cfg.OutputDir, "output-dir", cfg.OutputDir, "Directory for the output files of the input files, -archive and -input-glob (default . for -archive and -input-glob)")
+	flag.StringVar(&cfg.OutputExt, "output-ext", cfg.OutputExt, "Extension for output files (default .txt), input files are converted next to themselves when there is no -output")
+	flag.StringVar(&cfg.Parser.Format, "format", cfg.Parser.Format, "Output format (text, print, ansi, speech, troff, markdown, html, rtf, json)")
+	flag.StringVar(&cfg.Parser.Charset, "charset", cfg.Parser.Charset, "Character set of the document (raw, atari-st to translate the Atari ST characters to UTF-8)")
+	flag.StringVar(&cfg.Parser.LeadingBlankLines, "leading-blank-lines", cfg.Parser.LeadingBlankLines, "Blank lines at the start of the output (preserve, strip, strip-one)")
+	flag.BoolVar(&cfg.Parser.KeepComments, "keep-comments", cfg.Parser.KeepComments, "Keep the Ctrl-K comments in the output")
+	flag.BoolVar(&cfg.EmbedProvenance, "embed-provenance", cfg.EmbedProvenance, "Write the source filename, conversion time and convert-stw version as meta tags in the head of html output")
+	flag.BoolVar(&cfg.Parser.KeepPrinterCodes, "keep-printer-codes", cfg.Parser.KeepPrinterCodes, "Pass the raw printer codes between Ctrl-X markers through to the output")
+	flag.BoolVar(&cfg.Parser.PageMarkers, "page-markers", cfg.Parser.PageMarkers, "Mark page breaks in the output with a --- Page N --- line")
+	flag.BoolVar(&cfg.Parser.ContinuousPages, "continuous", cfg.Parser.ContinuousPages, "Do not break pages at the document's page length")
+	flag.BoolVar(&cfg.Parser.PageHeaders, "page-headers", cfg.Parser.PageHeaders, "Print the header and footer on each page")
+	flag.IntVar(&cfg.Parser.HeaderLines, "header-lines", cfg.Parser.HeaderLines, "Keep N lines below the top margin of each page for the header, it is printed on the first of them")
+	flag.IntVar(&cfg.Parser.FooterLines, "footer-lines", cfg.Parser.FooterLines, "Keep N lines above the bottom margin of each page for the footer, it is printed on the last of them")
+	flag.StringVar(&cfg.Parser.FormFeed, "form-feed", cfg.Parser.FormFeed, "Page breaks in text output (none, ff for a form feed, pad to fill the page with blank lines)")
+	flag.StringVar(&cfg.Parser.FlushInterval, "flush-interval", cfg.Parser.FlushInterval, "Flush the output after each page or paragraph, instead of none until the end")
+	flag.StringVar(&cfg.ExportHeaders, "export-headers", cfg.ExportHeaders, "Write the header active on each page to a file")
+	flag.StringVar(&cfg.ColumnOrder, "column-order-report", cfg.ColumnOrder, "Write the page, column and line on the column of each line laid out by -apply-margins to a file, in reading order")
+	flag.StringVar(&cfg.SplitPages, "split-pages", cfg.SplitPages, "Write each page to its own file, named by a template with a %d for the page number, eg. page-%03d.html")
+	flag.StringVar(&cfg.SplitOn, "split-on", cfg.SplitOn, "Where -split-pages starts the next file (page, eject, pagelength, heading)")
+	flag.StringVar(&cfg.ParagraphIndex, "paragraph-index", cfg.ParagraphIndex, "Write the page, line and text of each paragraph to a file, one paragraph per line")
+	flag.IntVar(&cfg.Parser.LineSpacing, "line-spacing", cfg.Parser.LineSpacing, "Override the document's line spacing when not 0")
+	flag.BoolVar(&cfg.FollowChain, "follow-chain", cfg.FollowChain, "Carry on into the files chained to with Ctrl-V, found next to the input")
+	flag.Var(headerSignature{&cfg.Parser.Signature}, "header-signature", "Header that comes before the document, with Go escapes like \\x00 (default \"Do Run Run STWRITER.PRG\\x00\")")
+	flag.BoolVar(&cfg.Parser.KeepPreamble, "keep-preamble", cfg.Parser.KeepPreamble, "Keep the bytes before the STWriter header, they are shown by -settings")
+	flag.BoolVar(&cfg.Parser.ScanForHeader, "scan-for-header", cfg.Parser.ScanForHeader, "Search all of the input for the STWriter header, not just the first 4KiB")
+	flag.BoolVar(&cfg.Parser.SplitOnMarker, "split-on-marker", cfg.Parser.SplitOnMarker, "Start a new document at each STWriter header, for concatenated files")
+	flag.StringVar(&cfg.ReplaceFile, "replace", cfg.ReplaceFile, "File of from<TAB>to substitutions to apply to the text")
+	flag.BoolVar(&cfg.ReplaceRegexp, "replace-regexp", cfg.ReplaceRegexp, "Treat the -replace rules as regular expressions")
+	flag.BoolVar(&cfg.ASCIIFold, "ascii-fold", cfg.ASCIIFold, "Fold smart quotes, dashes and ellipsis into plain ASCII")
+	flag.BoolVar(&cfg.StrictASCII, "strict-ascii", cfg.StrictASCII, "Replace everything except tab, newline and printable 7-bit ASCII")
+	flag.StringVar(&cfg.StrictASCIISub, "strict-ascii-sub", cfg.StrictASCIISub, "Replacement text used by -strict-ascii")
+	flag.BoolVar(&cfg.WordFreq, "word-freq", cfg.WordFreq, "Output a CSV of word frequencies instead of the document")
+	flag.BoolVar(&cfg.WordFreqFold, "word-freq-fold", cfg.WordFreqFold, "Lowercase words and strip punctuation for -word-freq")
+	flag.StringVar(&cfg.Annotations, "annotations", cfg.Annotations, "Report batch conversion warnings as CI annotations (github)")
+	flag.StringVar(&cfg.EncodingOut, "encoding-out", cfg.EncodingOut, "Output encoding (utf8, utf16le, utf16be)")
+	flag.StringVar(&cfg.EOL, "eol", cfg.EOL, "Line ending of the output (lf, crlf, cr)")
+	flag.BoolVar(&cfg.GzipOutput, "gzip-output", cfg.GzipOutput, "Compress the output with gzip, .gz is added to the -output-ext")
+	flag.BoolVar(&cfg.BOM, "bom", cfg.BOM, "Write a byte order mark at the start of UTF-16 output")
+	flag.Var(fontMap(cfg.Parser.FontMap), "map-font", "Remap a font number before it is used to another number or a font name, eg. 3=2 or 3=condensed (may be repeated)")
+	flag.IntVar(&cfg.DumpBytes, "dump-first-bytes", cfg.DumpBytes, "Dump the first N bytes of the input as hex and ASCII instead of converting it, 64 shows the header")
+	flag.IntVar(&cfg.Parser.SectionIndent, "section-indent", cfg.Parser.SectionIndent, "Indent text by N spaces for each section level")
+	flag.BoolVar(&cfg.Parser.NumberHeadings, "number-headings", cfg.Parser.NumberHeadings, "Number the section headings of text output as an outline, 1, 1.1, 1.1.1")
+	flag.BoolVar(&cfg.Parser.ApplySpacing, "apply-spacing", cfg.Parser.ApplySpacing, "Add blank lines for the document's line and paragraph spacing")
+	flag.BoolVar(&cfg.Parser.ApplyMargins, "apply-margins", cfg.Parser.ApplyMargins, "Lay the text out within the document's margins, indenting, wrapping and aligning it")
+	flag.BoolVar(&cfg.Parser.MergeColumns, "merge-columns", cfg.Parser.MergeColumns, "Reflow two column pages into one column within the first column's margins with -apply-margins")
+	flag.Var(codeMap(cfg.Parser.CodeMap), "map-code", "Replace an unknown control code with text, eg. 0x1b=[ESC] (may be repeated)")
 
 	flag.Parse()
 }
 
-/* readUntil reads bytes until the expected string is matched */
-func readUntil(fin *bufio.Reader, match []byte) error {
-	mIdx := 0
-	mBuff := make([]byte, 1)
-	for mIdx < len(match) {
-		n, err := fin.Read(mBuff)
-		if err != nil {
-			return err
-		}
-		if n == 0 {
-			// TODO Display how much didn't match
-			return errors.New("Input ended too early, no match found")
-		}
-		if mBuff[0] == match[mIdx] {
-			mIdx = mIdx + 1
-		} else {
-			// Wrong character, reset.
-			mIdx = 0
-		}
-	}
-	return nil
-}
+// maxDumpBytes is the most bytes -dump-first-bytes will dump, larger values are cut down to it
+const maxDumpBytes = 64 * 1024
 
-/* readInt reads a number of ASCII digits and returns them as an int */
-func readInt(fin *bufio.Reader, n int) (int, error) {
+/* dumpFirstBytes prints the first n bytes of the input as hex and ASCII */
+func dumpFirstBytes(fin io.Reader, n int) error {
 	buf := make([]byte, n)
 	nRead, err := io.ReadFull(fin, buf)
-	if err != nil {
-		return 0, err
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
 	}
-	if nRead != n {
-		return 0, fmt.Errorf("ERROR: readInt only read %d byte, not %d as expected", nRead, n)
+	fmt.Print(hex.Dump(buf[:nRead]))
+	return nil
+}
+
+/* printReports writes the reports about a converted document selected on the cmdline to w, after the document in the same output */
+func printReports(w io.Writer, settings *stw.Settings) {
+	if cfg.SettingsOut {
+		printDocumentSettings(w, settings)
 	}
-	value, err := strconv.Atoi(strings.TrimSpace(string(buf)))
-	if err != nil {
-		return 0, err
+	if cfg.StatsOut {
+		printDocumentStats(w, &settings.Structure)
 	}
-
-	return value, nil
 }
 
-/* readString reads characters until it hits a terminator byte */
-func readString(fin *bufio.Reader, terminate byte) ([]byte, error) {
-	buf := make([]byte, 80)
-	mBuff := make([]byte, 1)
-	for {
-		n, err := io.ReadFull(fin, mBuff)
-		if err != nil {
-			return nil, err
-		}
-		if n != 1 {
-			return nil, fmt.Errorf("ERROR: readString only read %d byte, not 1 as expected", n)
-		}
-		if mBuff[0] == terminate {
-			break
+/* newOutput wraps fout in the output compression, encoding, line endings and filters, finish flushes them once all of the output has been written */
+func newOutput(fout io.Writer) (out io.Writer, finish func() error, err error) {
+	out = fout
+	var zw *gzip.Writer
+	if cfg.GzipOutput {
+		zw = gzip.NewWriter(fout)
+		out = zw
+	}
+
+	var encoder *utf16Writer
+	if cfg.EncodingOut != "utf8" {
+		if encoder, err = newEncodingWriter(out, cfg.EncodingOut, cfg.BOM); err != nil {
+			return nil, nil, err
 		}
-		buf = append(buf, mBuff[0])
+		out = encoder
 	}
-	return buf, nil
-}
 
-/* convertStw reads a STWriter document and outputs an ASCII document */
-func convertStw(inDoc *bufio.Reader, outDoc *bufio.Writer) error {
-	var settings documentSettings
-	var nextByte byte
-	var err error
+	if cfg.EOL != "lf" {
+		out = &eolWriter{out: out, eol: []byte(lineEndings[cfg.EOL])}
+	}
 
-	// This *has* to come first
-	log.Println("Searching for STWriter file header")
-	if err = readUntil(inDoc, []byte("Do Run Run STWRITER.PRG\x00")); err != nil {
-		log.Fatal("Did not find STWriter file header")
+	var strict *filterWriter
+	var substitutions int
+	if cfg.StrictASCII {
+		strict = newStrictASCIIWriter(out, cfg.StrictASCIISub, &substitutions)
+		out = strict
 	}
 
-	for {
-		// How to order this? read bytes in state? Process state in byte parsing?
+	var folder *filterWriter
+	if cfg.ASCIIFold {
+		folder = newASCIIFoldWriter(out)
+		out = folder
+	}
 
-		if nextByte, err = inDoc.ReadByte(); err != nil {
-			break
-		}
+	var replacer *replaceWriter
+	if len(replaceRules) > 0 {
+		replacer = &replaceWriter{out: out, rules: replaceRules}
+		out = replacer
+	}
 
-		/*
-			0x02 Ctrl-B  Bottom Margin
-						 3 bytes '12 '
-			0x03 Ctrl-C  Center following text
-						 0 bytes
-						 2 Ctrl-C == Block Right line of text
-			0x04 Ctrl-D  Paragraph Spacing
-						 2 bytes '4 '
-			0x05 Ctrl-E  Page Eject
-			0x06 Ctrl-F  Footer
-						 Followed by footer line, @ in footer is replaced by page #
-						 2x Ctrl-F turns off footers
-			0x07 Ctrl-G  Font Change (0=pica, 1=bold, 2=condensed, 4=italics, 5=elite)
-						 2 bytes '0 '
-			0x08 Ctrl-H  Header
-						 2x Ctrl-H turns off headers
-			0x09 Ctrl-I  Paragraph Indentation
-						 2 bytes '5 '
-			0x0a Ctrl-J  Justification Toggle
-						 2 bytes '0 '
-			0x0b Ctrl-K  Comment until end of line
-			0x0c Ctrl-L  Left Margin
-						 3 bytes '10 '
-			0x0d Ctrl-M  2 column Left Margin
-			0x0e Ctrl-N  2 column Right Margin
-			0x0f Ctrl-O  Printer control code
-						 3 bytes '15 '
-			0x10 Ctrl-P  Paragraph
-			0x11 Ctrl-Q  Page # to start with
-						 3 bytes (can be negative)
-			0x12 Ctrl-R  Right Margin
-						 3 bytes '70 '
-			0x13 Ctrl-S  Line Spacing
-						 1 byte '2'
-			0x14 Ctrl-T  Top margin
-						 3 bytes '12 '
-			0x15 Ctrl-U  Section Heading Level
-						 1 byte
-			0x16 Ctrl-V  Link file, followed by path and filename
-						 Read until end of line
-			0x17 Ctrl-W  Page Wait
-			0x18 Ctrl-X  Escape printer codes, ended by Ctrl-X
-			0x19 Ctrl-Y  Lines Per Page
-						 Followed by 3 bytes of ASCII (eg. '132')
-			0x1a Ctrl-Z  Unused
-		*/
-		// Check for control codes
-		switch nextByte {
-		case 0x00: // End of a line/paragraph
-			outDoc.WriteByte('\n')
-
-			// Turn off line oriented flags
-			settings.Center = false
-			settings.BlockRight = false
-		case 0x02: // Set the Bottom Margin
-			value, err := readInt(inDoc, 3)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.MarginBottom = value
-			}
-		case 0x03: // Center or Block Right until end of line
-			if settings.Center {
-				settings.Center = false
-				settings.BlockRight = true
-			} else {
-				settings.Center = true
-			}
-		case 0x04: // Paragraph spacing
-			value, err := readInt(inDoc, 2)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.ParagraphSpacing = value
-			}
-		case 0x05: // Page Eject
-			// Ignore
-		case 0x06: // Footer
-			if settings.FooterCapture {
-				settings.FooterCapture = false
-				log.Printf("FOOTER: %s", settings.Footer)
-			} else {
-				settings.FooterCapture = true
-				settings.Footer = make([]byte, 80)
-			}
-		case 0x07: // Font change
-			value, err := readInt(inDoc, 2)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.Font = FontType(value)
-			}
-		case 0x08: // Header
-			if settings.HeaderCapture {
-				settings.HeaderCapture = false
-				log.Printf("HEADER: %s", settings.Header)
-			} else {
-				settings.HeaderCapture = true
-				settings.Header = make([]byte, 80)
-			}
-		case 0x09: // Paragraph Indent
-			value, err := readInt(inDoc, 2)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.Indent = value
-			}
-		case 0x0a: // Justification toggle
-			value, err := readInt(inDoc, 2)
-			if err != nil {
-				log.Println(err)
-			} else {
-				if value == 1 {
-					settings.Justified = true
-				} else {
-					settings.Justified = false
-				}
-			}
-		case 0x0b: // Comment until end of line
-			outDoc.Write([]byte("COMMENT: "))
-		case 0x0c: // Left Margin
-			value, err := readInt(inDoc, 3)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.MarginLeft = value
-			}
-		case 0x0d: // Column2 Left Margin
-			value, err := readInt(inDoc, 3)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.MarginLeft2 = value
-			}
-		case 0x0e: // Column2 Left Margin
-			value, err := readInt(inDoc, 3)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.MarginRight2 = value
-			}
-		case 0x0f: // Printer Control Code
-			// Read it and ignore it
-			_, err := readInt(inDoc, 3)
-			if err != nil {
-				log.Println(err)
+	finish = func() error {
+		if replacer != nil {
+			if err := replacer.Flush(); err != nil {
+				return err
 			}
-		case 0x10: // Paragraph
-			outDoc.Write([]byte("\n\n"))
-		case 0x11: // Starting page number
-			value, err := readInt(inDoc, 3)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.StartPageNum = value
-			}
-		case 0x12: // Right Margin
-			value, err := readInt(inDoc, 3)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.MarginRight = value
-			}
-		case 0x13: // Line spacing
-			value, err := readInt(inDoc, 1)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.LineSpacing = value
-			}
-		case 0x14: // Line spacing
-			value, err := readInt(inDoc, 3)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.MarginTop = value
-			}
-		case 0x15: // Section Heading Level
-			value, err := readInt(inDoc, 1)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.SectionLevel = value
-			}
-		case 0x16: // Chain filename
-			filename, err := readString(inDoc, 0x00)
-			if err != nil {
-				log.Println(err)
-			} else {
-				copy(settings.ChainFile, filename)
-			}
-		case 0x17: // Page Wait
-			// Ignore
-		case 0x18: // Escape Printer Control Codes
-			// Read until another 0x18
-			_, err := readString(inDoc, 0x18)
-			if err != nil {
-				log.Println(err)
+		}
+		if folder != nil {
+			if err := folder.Flush(); err != nil {
+				return err
 			}
-		case 0x19: // Lines per page
-			value, err := readInt(inDoc, 3)
-			if err != nil {
-				log.Println(err)
-			} else {
-				settings.PageLength = value
+		}
+		if strict != nil {
+			if err := strict.Flush(); err != nil {
+				return err
 			}
-		default:
-			// Skip any unprintable bytes that have slipped through
-			if !strconv.IsPrint(rune(nextByte)) {
-				break
+			info("Replaced %d non-ASCII characters", substitutions)
+		}
+		if encoder != nil {
+			if err := encoder.Flush(); err != nil {
+				return err
 			}
-			if settings.FooterCapture {
-				// Capture the footer
-				settings.Footer = append(settings.Footer, nextByte)
-			} else if settings.HeaderCapture {
-				// Capture the header
-				settings.Header = append(settings.Header, nextByte)
-			} else {
-				outDoc.WriteByte(nextByte)
+		}
+		if zw != nil {
+			if err := zw.Close(); err != nil {
+				return err
 			}
 		}
+		return nil
 	}
-	outDoc.Flush()
+	return out, finish, nil
+}
 
-	if cfg.SettingsOut {
-		printDocumentSettings(&settings)
+/* provenance returns the meta tags recording where the document at path came from, and when and by what it was converted */
+func provenance(path string) map[string]string {
+	version, _, _ := buildVersion()
+	meta := map[string]string{
+		"generator": "convert-stw " + version,
+		"converted": time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(path) > 0 {
+		meta["source"] = filepath.Base(path)
+	}
+	return meta
+}
+
+/* convertFile sets up the output encoding and converts one document */
+func convertFile(fin io.Reader, fout io.Writer) error {
+	fin, err := gunzip(fin)
+	if err != nil {
+		return err
+	}
+
+	out, finish, err := newOutput(fout)
+	if err != nil {
+		return err
+	}
+	pages := &pageFiles{template: cfg.SplitPages, out: out, finish: finish}
+	if len(cfg.SplitPages) > 0 {
+		cfg.Parser.SplitPage = pages.next
+	}
+	cfg.Parser.DocumentDone = func(settings *stw.Settings) {
+		printReports(pages.out, settings)
+	}
+
+	path := cfg.InFile
+	if len(batchFile) > 0 {
+		path = batchFile
+	}
+	if cfg.FollowChain {
+		cfg.Parser.FollowChain = newChainOpener(path).open
+	}
+	if cfg.EmbedProvenance {
+		cfg.Parser.Provenance = provenance(path)
+	}
+
+	var settings stw.Settings
+	if cfg.WordFreq {
+		settings, err = writeWordFreq(fin, out)
+	} else {
+		settings, err = cfg.Parser.Parse(fin, out)
 	}
+	if err != nil {
+		pages.close()
+		return err
+	}
+
+	// The reports go through the same encoding, line endings and compression as the document
+	printReports(pages.out, &settings)
+	return pages.close()
+}
+
+/* convertGlob converts every file matching pattern into outDir, carrying on past the ones that fail */
+func convertGlob(pattern, outDir string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	info("%d files match %s", len(matches), pattern)
+	return convertInputs(matches, outDir)
+}
+
+/* outputExt returns the extension for output files, defaulting to .txt, with .gz added for -gzip-output */
+func outputExt() string {
+	ext := cfg.OutputExt
+	if len(ext) == 0 {
+		ext = ".txt"
+	}
+	if cfg.GzipOutput {
+		ext = ext + ".gz"
+	}
+	return ext
+}
+
+/* convertInput converts one of the input files into outDir, next to itself when outDir is empty and there is an -output-ext, or to stdout */
+func convertInput(path, outDir string) error {
+	fin, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
 
+	var outPath string
+	name := trimGzipExt(path)
+	name = strings.TrimSuffix(name, filepath.Ext(name)) + outputExt()
+	if len(outDir) > 0 {
+		outPath = filepath.Join(outDir, filepath.Base(name))
+	} else if !batchStdout {
+		outPath = name
+	} else {
+		// Concatenate the documents
+		return convertFile(fin, os.Stdout)
+	}
+
+	info("Converting %s to %s", path, outPath)
+	fout, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	if err = convertFile(fin, fout); err != nil {
+		// Don't leave an empty or partial file behind
+		fout.Close()
+		os.Remove(outPath)
+		return err
+	}
+	return fout.Close()
+}
+
+/* convertInputs converts the input files into outDir, carrying on past the ones that fail */
+func convertInputs(paths []string, outDir string) error {
+	if len(outDir) > 0 {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return err
+		}
+	}
+	batchStdout = len(outDir) == 0 && len(cfg.OutputExt) == 0
+	failed := 0
+	for _, path := range paths {
+		batchFile = path
+		if err := convertInput(path, outDir); err != nil {
+			warning(fmt.Errorf("ERROR: %s: %s", path, err))
+			failed = failed + 1
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("ERROR: %d of %d files could not be converted", failed, len(paths))
+	}
 	return nil
 }
 
-/* main sets up the input and output files, calls convertStw */
-func main() {
+/* run sets up the input and output files, calls convertFile, and returns the error to exit with once the outputs are closed */
+func run() error {
 	parseArgs()
 
+	if cfg.Version {
+		printVersion()
+		return nil
+	}
+
+	switch cfg.Parser.Format {
+	case "text", "print", "ansi", "speech", "troff", "markdown", "html", "rtf", "json":
+	default:
+		return fmt.Errorf("ERROR: unknown output format %q", cfg.Parser.Format)
+	}
+	switch cfg.Parser.Charset {
+	case "raw", "atari-st":
+	default:
+		return fmt.Errorf("ERROR: unknown character set %q", cfg.Parser.Charset)
+	}
+	switch cfg.Parser.FormFeed {
+	case "none", "ff", "pad":
+	default:
+		return fmt.Errorf("ERROR: unknown -form-feed mode %q", cfg.Parser.FormFeed)
+	}
+	switch cfg.Parser.FlushInterval {
+	case "none", "page", "paragraph":
+	default:
+		return fmt.Errorf("ERROR: unknown -flush-interval %q", cfg.Parser.FlushInterval)
+	}
+	switch cfg.Parser.LeadingBlankLines {
+	case "preserve", "strip", "strip-one":
+	default:
+		return fmt.Errorf("ERROR: unknown -leading-blank-lines mode %q", cfg.Parser.LeadingBlankLines)
+	}
+	if cfg.Verbose && cfg.Quiet {
+		return errors.New("ERROR: -v and -q cannot be used together")
+	} else if cfg.Verbose {
+		cfg.Parser.LogLevel = stw.LogVerbose
+	} else if cfg.Quiet {
+		cfg.Parser.LogLevel = stw.LogQuiet
+	}
+	if cfg.Parser.HeaderLines < 0 || cfg.Parser.FooterLines < 0 {
+		return errors.New("ERROR: -header-lines and -footer-lines cannot be negative")
+	}
+	if cfg.DumpBytes < 0 {
+		return fmt.Errorf("ERROR: -dump-first-bytes %d is negative", cfg.DumpBytes)
+	} else if cfg.DumpBytes > maxDumpBytes {
+		info("Dumping the first %d bytes", maxDumpBytes)
+		cfg.DumpBytes = maxDumpBytes
+	}
+	if _, ok := lineEndings[cfg.EOL]; !ok {
+		return fmt.Errorf("ERROR: unknown -eol line ending %q", cfg.EOL)
+	}
+	if cfg.Annotations != "" && cfg.Annotations != "github" {
+		return fmt.Errorf("ERROR: unknown annotation format %q", cfg.Annotations)
+	}
+	switch cfg.SplitOn {
+	case "page", "eject", "pagelength", "heading":
+		cfg.Parser.SplitOn = cfg.SplitOn
+	default:
+		return fmt.Errorf("ERROR: unknown -split-on %q", cfg.SplitOn)
+	}
+	if cfg.SplitOn != "page" && len(cfg.SplitPages) == 0 {
+		return errors.New("ERROR: -split-on needs the -split-pages filename template")
+	}
+	if len(cfg.SplitPages) > 0 {
+		if err := checkPageTemplate(cfg.SplitPages); err != nil {
+			return err
+		}
+		if len(cfg.OutFile) > 0 || len(cfg.OutputExt) > 0 || len(cfg.Archive) > 0 || len(cfg.InputGlob) > 0 || len(flag.Args()) > 1 {
+			return errors.New("ERROR: -split-pages names the output files itself, it converts one input without -output, -output-ext, -archive or -input-glob")
+		}
+	}
+	cfg.Parser.Warning = warning
+	if cfg.Trace {
+		cfg.Parser.Trace = os.Stderr
+	}
+	if len(cfg.ExportHeaders) > 0 {
+		headerIndex, err := os.Create(cfg.ExportHeaders)
+		if err != nil {
+			return err
+		}
+		defer headerIndex.Close()
+		cfg.Parser.HeaderIndex = headerIndex
+	}
+	if len(cfg.ColumnOrder) > 0 {
+		if !cfg.Parser.ApplyMargins && cfg.Parser.Format != "print" {
+			return errors.New("ERROR: -column-order-report needs the lines laid out by -apply-margins or -format print")
+		}
+		columnOrder, err := os.Create(cfg.ColumnOrder)
+		if err != nil {
+			return err
+		}
+		defer columnOrder.Close()
+		cfg.Parser.ColumnOrder = columnOrder
+	}
+	if len(cfg.ParagraphIndex) > 0 {
+		paragraphIndex, err := os.Create(cfg.ParagraphIndex)
+		if err != nil {
+			return err
+		}
+		defer paragraphIndex.Close()
+		cfg.Parser.OnParagraph = func(text []byte, page, line int) {
+			fmt.Fprintf(paragraphIndex, "Page %d\tLine %d\t%s\n", page, line, strings.Replace(string(text), "\n", " ", -1))
+		}
+	}
+	if len(cfg.ReplaceFile) > 0 {
+		var err error
+		if replaceRules, err = readReplaceRules(cfg.ReplaceFile, cfg.ReplaceRegexp); err != nil {
+			return err
+		}
+	}
+
+	if cfg.SettingsSchema {
+		if err := printSettingsSchema(); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if cfg.Validate {
+		inputs := flag.Args()
+		if len(cfg.InFile) > 0 {
+			inputs = append([]string{cfg.InFile}, inputs...)
+		}
+		if err := validateInputs(inputs); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if cfg.CountPages {
+		inputs := flag.Args()
+		if len(cfg.InFile) > 0 {
+			inputs = append([]string{cfg.InFile}, inputs...)
+		}
+		if err := countPages(inputs); err != nil {
+			return err
+		}
+		return nil
+	}
+
 	var fin, fout *os.File
 	var err error
+	if len(cfg.Archive) > 0 || len(cfg.InputGlob) > 0 {
+		outDir := cfg.OutputDir
+		if len(outDir) == 0 {
+			outDir = "."
+		}
+		if len(cfg.Archive) > 0 {
+			err = convertArchive(cfg.Archive, outDir)
+		} else {
+			err = convertGlob(cfg.InputGlob, outDir)
+		}
+		if err != nil {
+			return err
+		}
+		return warningsError()
+	}
+
+	inputs := flag.Args()
+	if len(cfg.InFile) > 0 && len(inputs) > 0 {
+		inputs = append([]string{cfg.InFile}, inputs...)
+	}
+	if len(inputs) > 1 && len(cfg.OutFile) > 0 {
+		return errors.New("ERROR: -output names one output file, use -output-dir for the outputs of several inputs")
+	}
+	if len(inputs) == 1 && len(cfg.OutputExt) == 0 && len(cfg.OutputDir) == 0 {
+		cfg.InFile = inputs[0]
+	} else if len(inputs) > 0 {
+		if err = convertInputs(inputs, cfg.OutputDir); err != nil {
+			return err
+		}
+		return warningsError()
+	}
+
 	if len(cfg.InFile) > 0 {
 		if fin, err = os.Open(cfg.InFile); err != nil {
-			log.Fatal(err)
+			return err
 		}
 		defer fin.Close()
 	} else {
 		fin = os.Stdin
 	}
 
-	if len(cfg.OutFile) > 0 {
+	if cfg.DumpBytes > 0 {
+		if err = dumpFirstBytes(fin, cfg.DumpBytes); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if len(cfg.SplitPages) > 0 {
+		// The first page is the output, the rest are created by convertFile
+		if fout, err = os.Create(pageName(cfg.SplitPages, 1)); err != nil {
+			return err
+		}
+		defer fout.Close()
+	} else if len(cfg.OutFile) > 0 {
 		if fout, err = os.Create(cfg.OutFile); err != nil {
-			log.Fatal(err)
+			return err
 		}
 		defer fout.Close()
 	} else {
 		fout = os.Stdout
 	}
 
-	inDoc := bufio.NewReader(fin)
-	outDoc := bufio.NewWriter(fout)
-	if err = convertStw(inDoc, outDoc); err != nil {
+	if cfg.Encode {
+		if err = encodeMarkdown(fin, fout); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if err = convertFile(fin, fout); err != nil {
+		return err
+	}
+	return warningsError()
+}
+
+/* warningsError returns the error to exit with when there were warnings and -warnings-are-errors is set */
+func warningsError() error {
+	if cfg.WarningsAreErrors && warningCount > 0 {
+		return fmt.Errorf("ERROR: %d warnings during conversion", warningCount)
+	}
+	return nil
+}
+
+/* main runs the conversion and exits with an error after the deferred closes in run have flushed the outputs */
+func main() {
+	if err := run(); err != nil {
 		log.Fatal(err)
 	}
 }
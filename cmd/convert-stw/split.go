@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// pageFiles - The output of -split-pages, the parts after the first page are written to files named by a template
+type pageFiles struct {
+	template string
+	file     *os.File     // The file of the current part, nil for the first one which is the -output
+	out      io.Writer    // The output of the current part
+	finish   func() error // Flushes the output of the current part
+}
+
+/* pageName returns the filename of page number n from a template with a %d in it, eg. page-%03d.html */
+func pageName(template string, n int) string {
+	return fmt.Sprintf(template, n)
+}
+
+/* checkPageTemplate returns an error if template does not name each page differently */
+func checkPageTemplate(template string) error {
+	name := pageName(template, 1)
+	if strings.Contains(name, "%!") || name == pageName(template, 2) {
+		return fmt.Errorf("ERROR: -split-pages %q needs a %%d for the page number", template)
+	}
+	return nil
+}
+
+/* next finishes the part that has been written and creates the file for the part after it */
+func (f *pageFiles) next(parts int) (io.Writer, error) {
+	if err := f.close(); err != nil {
+		return nil, err
+	}
+	name := pageName(f.template, parts+1)
+	info("Writing part %d to %s", parts+1, name)
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	f.file = file
+	out, finish, err := newOutput(file)
+	if err != nil {
+		return nil, err
+	}
+	f.out = out
+	f.finish = finish
+	return out, nil
+}
+
+/* close finishes the output of the current part, and closes its file */
+func (f *pageFiles) close() error {
+	err := f.finish()
+	if f.file != nil {
+		if closeErr := f.file.Close(); err == nil {
+			err = closeErr
+		}
+		f.file = nil
+	}
+	return err
+}
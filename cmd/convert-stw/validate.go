@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* validateInputs parses the input files without writing any output, printing a summary line for each one */
+func validateInputs(paths []string) error {
+	if len(cfg.InputGlob) > 0 {
+		matches, err := filepath.Glob(cfg.InputGlob)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, matches...)
+	}
+
+	if len(paths) == 0 {
+		if !validate("stdin", os.Stdin) {
+			return fmt.Errorf("ERROR: stdin did not validate")
+		}
+		return nil
+	}
+
+	failed := 0
+	for _, path := range paths {
+		fin, err := os.Open(path)
+		if err != nil {
+			fmt.Printf("%s: ERROR %s\n", path, err)
+			failed = failed + 1
+			continue
+		}
+		batchFile = path
+		if !validate(path, fin) {
+			failed = failed + 1
+		}
+		fin.Close()
+	}
+	if failed > 0 {
+		return fmt.Errorf("ERROR: %d of %d files did not validate", failed, len(paths))
+	}
+	return nil
+}
+
+/* validate parses one document, printing OK or the problems found in it, and returns true if there were none */
+func validate(name string, fin io.Reader) bool {
+	var problems []string
+	p := cfg.Parser
+	p.Warning = func(err error) {
+		problems = append(problems, err.Error())
+	}
+	p.DocumentDone = nil
+	p.HeaderIndex = nil
+	p.ColumnOrder = nil
+	p.OnParagraph = nil
+	if cfg.FollowChain {
+		p.FollowChain = newChainOpener(batchFile).open
+	}
+	fin, err := gunzip(fin)
+	if err == nil {
+		_, err = p.Parse(fin, ioutil.Discard)
+	}
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s: OK\n", name)
+		return true
+	}
+	fmt.Printf("%s: %d errors: %s\n", name, len(problems), strings.Join(problems, "; "))
+	return false
+}
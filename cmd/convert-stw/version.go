@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Set by the linker, eg. -ldflags "-X main.version=1.0 -X main.commit=abc123 -X main.buildDate=2024-01-01"
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+/* buildVersion returns the version, commit and build date, the build info fills in the ones the linker did not set with the module version and the commit's revision and time */
+func buildVersion() (string, string, string) {
+	version, commit, buildDate := version, commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if len(version) == 0 && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if len(commit) == 0 {
+					commit = setting.Value
+				}
+			case "vcs.time":
+				if len(buildDate) == 0 {
+					buildDate = setting.Value
+				}
+			}
+		}
+	}
+	if len(version) == 0 {
+		version = "unknown"
+	}
+	if len(commit) == 0 {
+		commit = "unknown"
+	}
+	if len(buildDate) == 0 {
+		buildDate = "unknown"
+	}
+	return version, commit, buildDate
+}
+
+/* printVersion displays the version, commit and build date */
+func printVersion() {
+	version, commit, buildDate := buildVersion()
+	fmt.Printf("convert-stw %s\ncommit: %s\nbuilt: %s\n", version, commit, buildDate)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/bcl/convert-stw/stw"
+)
+
+// wordCount - Number of times a word appears in the document
+type wordCount struct {
+	Word  string
+	Count int
+}
+
+/* writeWordFreq converts the document and writes its word frequencies as CSV, most frequent first */
+func writeWordFreq(inDoc io.Reader, out io.Writer) (stw.Settings, error) {
+	var body bytes.Buffer
+	settings, err := cfg.Parser.Parse(inDoc, &body)
+	if err != nil {
+		return settings, err
+	}
+
+	counts := map[string]int{}
+	for _, word := range strings.Fields(body.String()) {
+		if cfg.WordFreqFold {
+			word = strings.ToLower(strings.TrimFunc(word, unicode.IsPunct))
+		}
+		if len(word) > 0 {
+			counts[word] = counts[word] + 1
+		}
+	}
+
+	var words []wordCount
+	for word, count := range counts {
+		words = append(words, wordCount{word, count})
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if words[i].Count != words[j].Count {
+			return words[i].Count > words[j].Count
+		}
+		return words[i].Word < words[j].Word
+	})
+
+	w := csv.NewWriter(out)
+	w.Write([]string{"word", "count"})
+	for _, wc := range words {
+		w.Write([]string{wc.Word, strconv.Itoa(wc.Count)})
+	}
+	w.Flush()
+	return settings, w.Error()
+}
@@ -0,0 +1,3 @@
+module github.com/bcl/convert-stw
+
+go 1.18
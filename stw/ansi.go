@@ -0,0 +1,17 @@
+package stw
+
+// ansiReset returns the terminal to its normal text
+const ansiReset = "\x1b[0m"
+
+/* ansiFont returns the escape codes that switch a terminal to a STWriter font */
+func ansiFont(font FontType) string {
+	switch font {
+	case BoldFont:
+		return ansiReset + "\x1b[1m"
+	case ItalicFont:
+		return ansiReset + "\x1b[3m"
+	case CondensedFont, EliteFont:
+		return ansiReset + "\x1b[2m"
+	}
+	return ansiReset
+}
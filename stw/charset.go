@@ -0,0 +1,37 @@
+package stw
+
+// atariST - The Unicode characters of the Atari ST character set from 0x7f to 0xff
+var atariST = [...]rune{
+	'⌂',
+	'Ç', 'ü', 'é', 'â', 'ä', 'à', 'å', 'ç', 'ê', 'ë', 'è', 'ï', 'î', 'ì', 'Ä', 'Å',
+	'É', 'æ', 'Æ', 'ô', 'ö', 'ò', 'û', 'ù', 'ÿ', 'Ö', 'Ü', '¢', '£', '¥', 'ß', 'ƒ',
+	'á', 'í', 'ó', 'ú', 'ñ', 'Ñ', 'ª', 'º', '¿', '⌐', '¬', '½', '¼', '¡', '«', '»',
+	'ã', 'õ', 'Ø', 'ø', 'œ', 'Œ', 'À', 'Ã', 'Õ', '¨', '´', '†', '¶', '©', '®', '™',
+	'ĳ', 'Ĳ', 'א', 'ב', 'ג', 'ד', 'ה', 'ו', 'ז', 'ח', 'ט', 'י', 'כ', 'ל', 'מ', 'נ',
+	'ס', 'ע', 'פ', 'צ', 'ק', 'ר', 'ש', 'ת', 'ן', 'ך', 'ם', 'ף', 'ץ', '§', '∧', '∞',
+	'α', 'β', 'Γ', 'π', 'Σ', 'σ', 'µ', 'τ', 'Φ', 'Θ', 'Ω', 'δ', '∮', 'ϕ', '∈', '∩',
+	'≡', '±', '≥', '≤', '⌠', '⌡', '÷', '≈', '°', '∙', '·', '√', 'ⁿ', '²', '³', '¯',
+}
+
+/* charset returns the character set of the document, defaulting to raw */
+func (p *Parser) charset() string {
+	if len(p.Charset) == 0 {
+		return "raw"
+	}
+	return p.Charset
+}
+
+/* atariSTText returns the UTF-8 text for an Atari ST character above 0x7e */
+func atariSTText(b byte) []byte {
+	return []byte(string(atariST[b-0x7f]))
+}
+
+/* atariSTByte returns the Atari ST character for a rune above 0x7e, ok is false when it is not in the character set */
+func atariSTByte(c rune) (b byte, ok bool) {
+	for i, r := range atariST {
+		if r == c {
+			return byte(0x7f + i), true
+		}
+	}
+	return '?', false
+}
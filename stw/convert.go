@@ -0,0 +1,874 @@
+package stw
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+)
+
+// Parser - Converts STWriter documents, the zero value converts to plain text
+//
+// The fields are only read while Parse is running, so they can all be changed
+// between calls to Parse, and one Parser can be reused for any number of files.
+// A Parser must not be changed while Parse is running. Parse can be called from
+// several goroutines at once as long as the callbacks, HeaderIndex and
+// ColumnOrder are safe to use concurrently.
+//
+// Markdown has no way to align text, so centered and block right lines are
+// written left aligned in the markdown format.
+type Parser struct {
+	Format            string            // Output format, text (the default), print, ansi, speech, troff, markdown, html, rtf, or json
+	Charset           string            // raw (the default) writes the bytes as they are, atari-st translates the Atari ST characters to UTF-8
+	CodeMap           map[byte]string   // Replacement text for unknown control codes
+	FontMap           map[int]int       // Remapped font numbers for nonstandard documents
+	SectionIndent     int               // Spaces to indent the text for each section level
+	NumberHeadings    bool              // Number the section headings of text and ansi output as an outline, 1, 1.1, 1.1.1
+	ApplyMargins      bool              // Lay the text out within the margins, indenting, wrapping and aligning it
+	MergeColumns      bool              // Lay the second column set by Ctrl-M and Ctrl-N out as part of one column within the primary margins
+	ApplySpacing      bool              // Add blank lines for the line and paragraph spacing
+	LeadingBlankLines string            // preserve (the default), strip, or strip-one of the blank lines at the start
+	PageMarkers       bool              // Mark the page breaks from Ctrl-E and PageLength in the output
+	ContinuousPages   bool              // Do not break the pages of text output at the page length
+	PageHeaders       bool              // Print the header and footer on each page of text output
+	HeaderLines       int               // Lines kept for the header at the top of each page, below the top margin
+	FooterLines       int               // Lines kept for the footer at the bottom of each page, above the bottom margin
+	FormFeed          string            // none (the default), ff to write a form feed at page breaks, or pad to fill out the page with blank lines
+	FlushInterval     string            // none (the default) only flushes the output at the end, page or paragraph also flush it after each one
+	LineSpacing       int               // Use this line spacing instead of the document's when it is not 0
+	SplitOnMarker     bool              // Start a new document at each STWriter header in the input
+	ScanForHeader     bool              // Search all of the input for the STWriter header, not just the first 4KiB
+	Signature         []byte            // The header that comes before the document, Signature when it is empty
+	KeepPreamble      bool              // Keep the bytes before the header in the settings' Preamble
+	CheckLineWidth    bool              // Warn about lines with words wider than the margins
+	NormalizeSpace    bool              // Collapse the runs of spaces in the text into one space
+	StripCR           bool              // Drop the stray 0x0d and 0x0a bytes that are not followed by the number of a Ctrl-M or Ctrl-J
+	TabWidth          int               // Expand each tab in the text into this many spaces, tabs are kept when 0
+	Strict            bool              // Return an error for malformed control data instead of warning about it
+	MaxBytes          int64             // Stop with ErrTooLarge after reading this much input, including chained files, 0 is no limit
+	RaggedNumbers     bool              // Read the numbers after control codes up to the first character that is not a digit, instead of at their fixed width
+	KeepComments      bool              // Write the Ctrl-K comments to the output, they are left out when false
+	KeepPrinterCodes  bool              // Write the raw bytes between Ctrl-X markers to the output, they may not be printable
+	Provenance        map[string]string // Written as <meta> tags with these names and contents in the head of html output
+	HeaderIndex       io.Writer         // Write the header active on each page to this
+	ColumnOrder       io.Writer         // Write the page, column and line of each line laid out by ApplyMargins to this, in the order they are read
+	Trace             io.Writer         // Write a line for each control code to this with its offset, name and argument bytes, and for the skipped bytes at LogVerbose
+	Warning           func(err error)   // Called with problems the conversion continues past, logs them when nil
+	LogLevel          LogLevel          // How much is logged about the conversion
+	DocumentDone      func(*Settings)   // Called with the settings of each document ended by SplitOnMarker
+
+	// FollowChain opens the file a document chains to with Ctrl-V, the conversion
+	// carries on into it at the end of the document. It should refuse to open a
+	// file that has already been converted, so a chain cannot loop.
+	FollowChain func(name string) (io.ReadCloser, error)
+
+	// OnControl is called with each control code once it has been parsed. value is
+	// its number and text is the finished header or footer, the chained filename
+	// or the printer codes, they are 0 and nil when the code has none.
+	OnControl func(code byte, value int, text []byte)
+
+	// OnParagraph is called with the text of each paragraph that has any at the
+	// Ctrl-P that ends it, and with the last one at the end of the document. The
+	// line ends in it are newlines, and page and line are the page number and the
+	// line on the page where it starts.
+	OnParagraph func(text []byte, page, line int)
+
+	// SplitPage is called when the first byte of each part after the first one is
+	// read, with the number of parts that have been written, and returns the
+	// writer for the new part. Each part is written as a document of its own with
+	// the header at its start and the footer at its end. SplitOn picks where the
+	// parts end, by default they are pages, ending at Ctrl-E and when their lines
+	// fill the page length, as Structure.Pages counts them, so the lines wrapped by
+	// ApplyMargins do not move the page breaks.
+	SplitPage func(parts int) (io.Writer, error)
+
+	// SplitOn is where SplitPage starts each part, page (the default) at Ctrl-E
+	// and the page length, eject at Ctrl-E only, pagelength at the page length
+	// only, or heading at each section heading after some text.
+	SplitOn string
+}
+
+// maxChainDepth is the most chained files that are followed from one document
+const maxChainDepth = 16
+
+// contextCheckBytes is how many bytes are parsed between the checks for a cancelled context
+const contextCheckBytes = 4096
+
+/* format returns the output format, defaulting to text */
+func (p *Parser) format() string {
+	if len(p.Format) == 0 {
+		return "text"
+	}
+	return p.Format
+}
+
+/* signature returns the header that comes before the document, defaulting to Signature */
+func (p *Parser) signature() []byte {
+	if len(p.Signature) == 0 {
+		return Signature
+	}
+	return p.Signature
+}
+
+/* logf logs a message about the conversion when the LogLevel includes level */
+func (p *Parser) logf(level LogLevel, format string, args ...interface{}) {
+	if level <= p.LogLevel {
+		log.Printf(format, args...)
+	}
+}
+
+/* warning reports a problem that the conversion can continue past */
+func (p *Parser) warning(settings *Settings, w Warning) {
+	settings.Warnings = append(settings.Warnings, w)
+	if p.Warning != nil {
+		p.Warning(w)
+	} else {
+		log.Println(w)
+	}
+}
+
+// byteText holds each byte value, so printable can return a byte as text without allocating it
+var byteText = func() (text [256]byte) {
+	for i := range text {
+		text[i] = byte(i)
+	}
+	return text
+}()
+
+/* printable returns the text for a byte that is not a control code, ok is false when it should be skipped */
+func (p *Parser) printable(b byte) (text []byte, ok bool) {
+	if replacement, ok := p.CodeMap[b]; ok {
+		// Make unknown codes visible when asked to
+		return []byte(replacement), true
+	}
+	if b >= 0x7f && p.charset() == "atari-st" {
+		return atariSTText(b), true
+	}
+	if !strconv.IsPrint(rune(b)) {
+		return nil, false
+	}
+	return byteText[b : int(b)+1 : int(b)+1], true
+}
+
+/* collapseSpaces drops the spaces in text that come after another space, space is true when the text before it ended with one */
+func collapseSpaces(text []byte, space bool) []byte {
+	var collapsed []byte
+	for _, b := range text {
+		if b == ' ' && space {
+			continue
+		}
+		space = b == ' '
+		collapsed = append(collapsed, b)
+	}
+	return collapsed
+}
+
+/* expandTabs replaces each tab in text with width spaces, keeping them when width is 0 */
+func expandTabs(text []byte, width int) []byte {
+	if width <= 0 || bytes.IndexByte(text, '\t') < 0 {
+		return text
+	}
+	return bytes.Replace(text, []byte{'\t'}, bytes.Repeat([]byte{' '}, width), -1)
+}
+
+/* Convert reads a STWriter document and outputs an ASCII document */
+func Convert(r io.Reader, w io.Writer) (Settings, error) {
+	return ConvertContext(context.Background(), r, w)
+}
+
+/* ConvertContext is Convert, stopping with the context's error when it is cancelled */
+func ConvertContext(ctx context.Context, r io.Reader, w io.Writer) (Settings, error) {
+	var p Parser
+	return p.ParseContext(ctx, r, w)
+}
+
+/* ParseSettings reads a STWriter document without writing it out and returns its settings, the warnings are only kept in them instead of being logged */
+func ParseSettings(r io.Reader) (Settings, error) {
+	p := Parser{LogLevel: LogQuiet, Warning: func(err error) {}}
+	return p.Parse(r, ioutil.Discard)
+}
+
+/* CountPages reads a STWriter document without writing it out and returns the pages it fills, as Structure.Pages counts them, for all of the documents split by SplitOnMarker */
+func (p *Parser) CountPages(r io.Reader) (int, error) {
+	pages := 0
+	counter := *p
+	counter.HeaderIndex = nil
+	counter.ColumnOrder = nil
+	counter.Trace = nil
+	counter.SplitPage = nil
+	counter.DocumentDone = func(settings *Settings) {
+		pages = pages + settings.Structure.Pages
+	}
+	settings, err := counter.Parse(r, ioutil.Discard)
+	return pages + settings.Structure.Pages, err
+}
+
+// Parse reads a STWriter document and outputs it in the Parser's format, returning the settings at EOF.
+// A *bufio.Writer is written to as it is, but r is always read through a buffer of Parse's own, even
+// when it is a *bufio.Reader, since the warning offsets and MaxBytes count the bytes read from r
+func (p *Parser) Parse(r io.Reader, w io.Writer) (Settings, error) {
+	return p.ParseContext(context.Background(), r, w)
+}
+
+// ParseContext is Parse, checking the context every 4KiB of the document and returning its error
+// once it is cancelled, with what was converted before it written out
+func (p *Parser) ParseContext(ctx context.Context, r io.Reader, w io.Writer) (Settings, error) {
+	limit := int64(-1)
+	if p.MaxBytes > 0 {
+		limit = p.MaxBytes
+	}
+	// The offsets and MaxBytes count the bytes read from r, under the buffer. A caller's
+	// *bufio.Reader cannot be reused, the bytes it has buffered were read before Parse
+	// and there is no way to count the ones taken out of it, so it is read through another one
+	counter := &countingReader{r: r, limit: limit}
+	inDoc := bufio.NewReader(counter)
+	// A *bufio.Writer is written to as it is, and flushed at the end of each document
+	outDoc, buffered := w.(*bufio.Writer)
+	if !buffered || p.SplitPage != nil {
+		// SplitPage resets the writer to each page's, which must not change the caller's
+		outDoc = bufio.NewWriter(w)
+	}
+	var settings Settings
+	var nextByte byte
+	out, err := p.newRenderer(outDoc, &settings)
+	if err != nil {
+		return settings, err
+	}
+	switch p.charset() {
+	case "raw", "atari-st":
+	default:
+		return settings, fmt.Errorf("unknown character set %q", p.Charset)
+	}
+	var codeOffset int64     // Offset of the byte being parsed
+	var strictErr error      // The first problem with the control data when Strict is set
+	var lineText bool        // Text has been written since the last line end
+	var inComment bool       // The rest of the line is a comment that is being left out
+	var commentLine bool     // The comment is all of the line, so its line end is left out too
+	var traceArgs []byte     // The bytes after the control code being parsed, for the Trace
+	var paragraphText []byte // Text of the current paragraph, for OnParagraph
+	var paragraphPage int    // Page the current paragraph starts on
+	var paragraphLine int    // Line on the page the current paragraph starts on
+	var afterSpace bool      // The last text written ended with a space, for NormalizeSpace
+	var splitAt Structure    // The counts where the part in the writer from SplitPage started
+	var splitParts int       // Parts that have been written to writers from SplitPage
+	var parsed int           // Bytes parsed since the context was checked
+
+	// warning reports a problem with the byte being parsed, Strict stops the conversion at the first one
+	warning := func(err error) {
+		w := newWarning(codeOffset, nextByte, err)
+		if p.Strict {
+			if strictErr == nil {
+				strictErr = w
+			}
+			return
+		}
+		p.warning(&settings, w)
+	}
+
+	// readNumber reads the number after a control code, n bytes wide unless RaggedNumbers is set
+	readNumber := func(n int) (int, error) {
+		if p.RaggedNumbers {
+			return readIntUntil(inDoc)
+		}
+		return readInt(inDoc, n)
+	}
+
+	// readShortNumber reads a 2 byte number that may be cut short by the next control code, any width when RaggedNumbers is set
+	readShortNumber := func() (value int, short bool, err error) {
+		if p.RaggedNumbers {
+			value, err = readIntUntil(inDoc)
+			return value, false, err
+		}
+		return readShortInt(inDoc)
+	}
+
+	// leftMargin returns a left margin, a negative one is used as 0 so the lines can be indented by it
+	leftMargin := func(value int) int {
+		if value < 0 {
+			warning(fmt.Errorf("WARNING: left margin %d is negative, using 0", value))
+			return 0
+		}
+		return value
+	}
+
+	// control passes the control code being parsed to OnControl
+	control := func(value int, text []byte) {
+		if p.LogLevel >= LogVerbose {
+			// Only box the arguments when they are logged, this is called for every control code
+			p.logf(LogVerbose, "at offset 0x%X: control code 0x%02x value %d text %q", codeOffset, nextByte, value, text)
+		}
+		if p.Trace != nil {
+			// Arguments longer than the bytes kept are strings, they are traced as the text that was read
+			n := int(counter.n - int64(inDoc.Buffered()) - codeOffset - 1)
+			args := text
+			if n <= len(traceArgs) {
+				args = traceArgs[:n]
+			}
+			p.trace(codeOffset, nextByte, args, value)
+		}
+		if p.OnControl != nil {
+			p.OnControl(nextByte, value, text)
+		}
+	}
+
+	// capture appends text to the header or footer, dropping what is past maxStringLen with one warning
+	capture := func(name string, buf []byte, text []byte) []byte {
+		if len(buf) >= maxStringLen {
+			return buf
+		}
+		if len(buf)+len(text) > maxStringLen {
+			warning(fmt.Errorf("WARNING: the %s is longer than %d bytes, the rest of it is dropped", name, maxStringLen))
+			text = text[:maxStringLen-len(buf)]
+		}
+		return append(buf, text...)
+	}
+
+	// newDocument resets the settings at the start of each document
+	newDocument := func(documents int) {
+		settings = Settings{}
+		splitAt = Structure{}
+		lineText = false
+		inComment = false
+		commentLine = false
+		if p.LineSpacing != 0 {
+			settings.LineSpacing = p.LineSpacing
+		}
+		out.startDocument(documents, 0)
+	}
+
+	// paragraphDone passes the text of the paragraph that has ended to OnParagraph
+	paragraphDone := func() {
+		text := bytes.TrimRight(paragraphText, "\n")
+		if p.OnParagraph != nil && len(text) > 0 {
+			p.OnParagraph(append([]byte{}, text...), paragraphPage, paragraphLine)
+		}
+		paragraphText = paragraphText[:0]
+	}
+
+	// pageFooter writes the footer at the end of each page written to its own writer by SplitPage
+	pageFooter := func() {
+		if p.SplitPage != nil && len(settings.Footer) > 0 && !settings.FooterCapture {
+			out.footer()
+		}
+	}
+
+	// finishDocument completes the settings once all of the document has been read
+	finishDocument := func(more bool) {
+		paragraphDone()
+		settings.Structure.finish()
+		pageFooter()
+		out.endDocument(more)
+		outDoc.Flush()
+	}
+
+	// splitDue returns true when nextByte starts the next part written by SplitPage, a part only ends at a heading once it has some text
+	splitDue := func(nextByte byte) bool {
+		s := &settings.Structure
+		switch p.SplitOn {
+		case "eject":
+			return s.PageEjects > splitAt.PageEjects
+		case "pagelength":
+			return s.Pages-s.PageEjects > splitAt.Pages-splitAt.PageEjects
+		case "heading":
+			if nextByte != 0x15 || s.ParagraphChars+s.paragraphLen <= splitAt.ParagraphChars+splitAt.paragraphLen {
+				return false
+			}
+			level, err := inDoc.Peek(1)
+			return err == nil && level[0] >= '1' && level[0] <= '9'
+		}
+		return s.Pages > splitAt.Pages
+	}
+
+	// splitPage finishes the part that has ended, and starts the next one in the writer from SplitPage
+	splitPage := func() error {
+		pageFooter()
+		out.endDocument(false)
+		outDoc.Flush()
+		splitParts = splitParts + 1
+		next, err := p.SplitPage(splitParts)
+		if err != nil {
+			return err
+		}
+		splitAt = settings.Structure
+		outDoc.Reset(next)
+		out.startDocument(1, splitAt.Pages)
+		if len(settings.Header) > 0 && !settings.HeaderCapture {
+			out.header()
+		}
+		return nil
+	}
+
+	if err = ctx.Err(); err != nil {
+		return settings, err
+	}
+	documents := 1
+	newDocument(documents)
+	chained := 0 // Chained files that have been followed
+
+	// This *has* to come first
+	signature := p.signature()
+	p.logf(LogInfo, "Searching for STWriter file header")
+	if !p.ScanForHeader {
+		// Fail fast instead of reading all of a file that is not a STWriter document
+		start, err := inDoc.Peek(headerSniffSize)
+		if err != nil && err != io.EOF {
+			return settings, err
+		}
+		if !bytes.Contains(start, signature) {
+			return settings, ErrNoHeader
+		}
+	}
+	var preamble *[]byte
+	if p.KeepPreamble {
+		preamble = &settings.Preamble
+	}
+	if err = readUntil(inDoc, signature, preamble); err == io.EOF {
+		return settings, ErrNoHeader
+	} else if err != nil {
+		return settings, err
+	}
+
+	for {
+		// How to order this? read bytes in state? Process state in byte parsing?
+
+		if strictErr != nil {
+			finishDocument(false)
+			return settings, strictErr
+		}
+
+		parsed = parsed + 1
+		if parsed == contextCheckBytes {
+			parsed = 0
+			if err = ctx.Err(); err != nil {
+				finishDocument(false)
+				return settings, err
+			}
+		}
+
+		codeOffset = counter.n - int64(inDoc.Buffered())
+		if nextByte, err = inDoc.ReadByte(); err == io.EOF {
+			if len(settings.ChainFile) == 0 || p.FollowChain == nil {
+				break
+			}
+			if chained == maxChainDepth {
+				p.warning(&settings, newWarning(-1, 0, fmt.Errorf("WARNING: not following the chain to %s, it is more than %d files long", settings.ChainFile, maxChainDepth)))
+				break
+			}
+			name := string(settings.ChainFile)
+			p.logf(LogInfo, "Following the chain to %s", name)
+			chain, err := p.FollowChain(name)
+			if err != nil {
+				p.warning(&settings, newWarning(-1, 0, fmt.Errorf("WARNING: could not follow the chain to %s: %w", name, err)))
+				break
+			}
+			defer chain.Close()
+			chained = chained + 1
+
+			// The settings carry on into the chained file
+			settings.ChainFile = nil
+			counter = &countingReader{r: chain, limit: counter.limit}
+			inDoc.Reset(counter)
+			if err = readUntil(inDoc, signature, nil); err != nil {
+				p.warning(&settings, newWarning(-1, 0, fmt.Errorf("WARNING: %s is not a STWriter file", name)))
+				break
+			}
+			continue
+		} else if err != nil {
+			// Keep what was converted before the read failed
+			finishDocument(false)
+			return settings, fmt.Errorf("at offset 0x%X: %w", codeOffset, err)
+		}
+
+		if p.Trace != nil && nextByte < 0x20 {
+			args, _ := inDoc.Peek(traceArgsSize)
+			traceArgs = append(traceArgs[:0], args...)
+		}
+
+		// The next part is only started once there is more of the document for it
+		if p.SplitPage != nil && splitDue(nextByte) {
+			if err = splitPage(); err != nil {
+				return settings, err
+			}
+		}
+
+		// Files that passed through other systems can have CR and LF line ends added to them
+		if p.StripCR && (nextByte == 0x0d || nextByte == 0x0a) {
+			width := 3
+			if nextByte == 0x0a {
+				width = 2
+			}
+			if !numberFollows(inDoc, width) {
+				p.logf(LogVerbose, "at offset 0x%X: dropped a stray 0x%02x", codeOffset, nextByte)
+				continue
+			}
+		}
+
+		// Concatenated files have another header where the next document starts
+		if p.SplitOnMarker && nextByte == signature[0] {
+			if next, err := inDoc.Peek(len(signature) - 1); err == nil && bytes.Equal(next, signature[1:]) {
+				inDoc.Discard(len(next))
+				finishDocument(true)
+				if p.DocumentDone != nil {
+					p.DocumentDone(&settings)
+				}
+				documents = documents + 1
+				newDocument(documents)
+				continue
+			}
+		}
+
+		/*
+			0x02 Ctrl-B  Bottom Margin
+						 3 bytes '12 '
+			0x03 Ctrl-C  Center following text
+						 0 bytes
+						 2 Ctrl-C == Block Right line of text
+			0x04 Ctrl-D  Paragraph Spacing
+						 2 bytes '4 '
+			0x05 Ctrl-E  Page Eject
+			0x06 Ctrl-F  Footer
+						 Followed by footer line, @ in footer is replaced by page #
+						 2x Ctrl-F turns off footers
+			0x07 Ctrl-G  Font Change (0=pica, 1=bold, 2=condensed, 4=italics, 5=elite)
+						 2 bytes '0 '
+			0x08 Ctrl-H  Header
+						 2x Ctrl-H turns off headers
+			0x09 Ctrl-I  Paragraph Indentation
+						 2 bytes '5 '
+			0x0a Ctrl-J  Justification Toggle
+						 2 bytes '0 '
+			0x0b Ctrl-K  Comment until end of line
+			0x0c Ctrl-L  Left Margin
+						 3 bytes '10 '
+			0x0d Ctrl-M  2 column Left Margin
+						 3 bytes '45 '
+			0x0e Ctrl-N  2 column Right Margin
+						 3 bytes '75 '
+			0x0f Ctrl-O  Printer control code
+						 3 bytes '15 '
+			0x10 Ctrl-P  Paragraph
+			0x11 Ctrl-Q  Page # to start with
+						 3 bytes (can be negative)
+			0x12 Ctrl-R  Right Margin
+						 3 bytes '70 '
+			0x13 Ctrl-S  Line Spacing
+						 2 bytes '2 ', or 1 byte when a control code follows it
+			0x14 Ctrl-T  Top margin
+						 3 bytes '12 '
+			0x15 Ctrl-U  Section Heading Level
+						 1 byte
+			0x16 Ctrl-V  Link file, followed by path and filename
+						 Read until end of line
+			0x17 Ctrl-W  Page Wait
+			0x18 Ctrl-X  Escape printer codes, ended by Ctrl-X
+			0x19 Ctrl-Y  Lines Per Page
+						 Followed by 3 bytes of ASCII (eg. '132')
+			0x1a Ctrl-Z  Unused
+		*/
+		// Check for control codes
+		switch nextByte {
+		case 0x00: // End of a line/paragraph
+			if len(paragraphText) > 0 {
+				paragraphText = append(paragraphText, '\n')
+			}
+			if !commentLine {
+				out.lineEnd()
+				settings.Structure.addLines(settings.lineSpacing(), settings.bodyLines(p.HeaderLines+p.FooterLines))
+			}
+			lineText = false
+			inComment = false
+			commentLine = false
+			settings.Structure.LineEnds = settings.Structure.LineEnds + 1
+			if settings.Center {
+				settings.Structure.CenteredLines = settings.Structure.CenteredLines + 1
+			}
+
+			// Turn off line oriented flags
+			settings.Center = false
+			settings.BlockRight = false
+			control(0, nil)
+		case 0x02: // Set the Bottom Margin
+			value, err := readNumber(3)
+			if err != nil {
+				warning(err)
+			} else {
+				settings.MarginBottom = value
+				control(value, nil)
+			}
+		case 0x03: // Center or Block Right until end of line
+			if settings.Center {
+				settings.Center = false
+				settings.BlockRight = true
+			} else {
+				settings.Center = true
+			}
+			control(0, nil)
+		case 0x04: // Paragraph spacing
+			value, err := readNumber(2)
+			if err != nil {
+				warning(err)
+			} else {
+				settings.ParagraphSpacing = value
+				control(value, nil)
+			}
+		case 0x05: // Page Eject
+			if p.SplitPage == nil || p.SplitOn == "pagelength" || p.SplitOn == "heading" {
+				// SplitPage starts the next part with the next byte
+				out.pageEject()
+			}
+			if p.FlushInterval == "page" || p.FlushInterval == "paragraph" {
+				outDoc.Flush()
+			}
+			settings.Structure.PageEjects = settings.Structure.PageEjects + 1
+			settings.Structure.endPage()
+			control(0, nil)
+		case 0x06: // Footer
+			if settings.FooterCapture {
+				settings.FooterCapture = false
+				p.logf(LogInfo, "FOOTER: %s", settings.Footer)
+				if p.SplitPage == nil {
+					// SplitPage writes it at the end of each page
+					out.footer()
+				}
+				control(0, settings.Footer)
+			} else {
+				settings.FooterCapture = true
+				settings.Footer = make([]byte, 0, 80)
+				control(0, nil)
+			}
+		case 0x07: // Font change
+			value, short, err := readShortNumber()
+			if short {
+				warning(fmt.Errorf("WARNING: font number is missing its second byte, read 1 byte instead"))
+			}
+			if err != nil {
+				warning(err)
+			} else {
+				if font, ok := p.FontMap[value]; ok {
+					value = font
+				}
+				settings.Font = FontType(value)
+				if _, ok := fontNames[settings.Font]; !ok {
+					warning(fmt.Errorf("WARNING: font %d is not a STWriter font, using pica", value))
+					settings.Font = PicaFont
+				}
+				out.fontChange()
+				settings.Structure.addFont(settings.Font)
+				control(value, nil)
+			}
+		case 0x08: // Header
+			if settings.HeaderCapture {
+				settings.HeaderCapture = false
+				p.logf(LogInfo, "HEADER: %s", settings.Header)
+				out.header()
+				control(0, settings.Header)
+			} else {
+				settings.HeaderCapture = true
+				settings.Header = make([]byte, 0, 80)
+				control(0, nil)
+			}
+		case 0x09: // Paragraph Indent
+			value, err := readNumber(2)
+			if err != nil {
+				warning(err)
+			} else {
+				settings.Indent = value
+				control(value, nil)
+			}
+		case 0x0a: // Justification toggle
+			value, err := readNumber(2)
+			if err != nil {
+				warning(err)
+			} else {
+				if value == 1 {
+					settings.Justified = true
+				} else {
+					settings.Justified = false
+				}
+				control(value, nil)
+			}
+		case 0x0b: // Comment until end of line
+			if p.KeepComments {
+				out.comment()
+			} else {
+				inComment = true
+				commentLine = !lineText
+			}
+			control(0, nil)
+		case 0x0c: // Left Margin
+			value, err := readNumber(3)
+			if err != nil {
+				warning(err)
+			} else {
+				settings.MarginLeft = leftMargin(value)
+				control(settings.MarginLeft, nil)
+			}
+		case 0x0d: // Column2 Left Margin
+			value, err := readNumber(3)
+			if err != nil {
+				warning(err)
+			} else {
+				settings.MarginLeft2 = leftMargin(value)
+				control(settings.MarginLeft2, nil)
+			}
+		case 0x0e: // Column2 Right Margin
+			value, err := readNumber(3)
+			if err != nil {
+				warning(err)
+			} else {
+				settings.MarginRight2 = value
+				control(value, nil)
+			}
+		case 0x0f: // Printer Control Code
+			value, err := readNumber(3)
+			if err != nil {
+				warning(err)
+			} else {
+				settings.PrinterCodes = append(settings.PrinterCodes, value)
+				control(value, nil)
+			}
+		case 0x10: // Paragraph
+			out.paragraph()
+			if p.FlushInterval == "paragraph" {
+				outDoc.Flush()
+			}
+			lineText = false
+			inComment = false
+			commentLine = false
+			settings.Structure.ParagraphEnds = settings.Structure.ParagraphEnds + 1
+			paragraphDone()
+			settings.Structure.endParagraph()
+			settings.Structure.addLines(1+settings.paragraphSpacing(), settings.bodyLines(p.HeaderLines+p.FooterLines))
+			control(0, nil)
+		case 0x11: // Starting page number
+			value, err := readNumber(3)
+			if err != nil {
+				warning(err)
+			} else {
+				settings.StartPageNum = value
+				control(value, nil)
+			}
+		case 0x12: // Right Margin
+			value, err := readNumber(3)
+			if err != nil {
+				warning(err)
+			} else {
+				settings.MarginRight = value
+				control(value, nil)
+			}
+		case 0x13: // Line spacing
+			value, _, err := readShortNumber()
+			if err != nil {
+				warning(err)
+			} else {
+				if p.LineSpacing == 0 {
+					settings.LineSpacing = value
+				}
+				control(value, nil)
+			}
+		case 0x14: // Top Margin
+			value, err := readNumber(3)
+			if err != nil {
+				warning(err)
+			} else {
+				settings.MarginTop = value
+				control(value, nil)
+			}
+		case 0x15: // Section Heading Level
+			value, err := readNumber(1)
+			if err != nil {
+				warning(err)
+			} else {
+				if value < 0 || value > maxSectionLevel {
+					level := 0
+					if value > 0 {
+						level = maxSectionLevel
+					}
+					warning(fmt.Errorf("WARNING: section level %d is not from 0 to %d, using %d", value, maxSectionLevel, level))
+					value = level
+				}
+				settings.SectionLevel = value
+				out.heading()
+				control(value, nil)
+			}
+		case 0x16: // Chain filename
+			filename, err := readString(inDoc, 0x00)
+			if err != nil {
+				warning(err)
+			}
+			if len(filename) > 0 || err == nil {
+				// An unterminated filename at the end of the file is still used
+				settings.ChainFile = filename
+				control(0, filename)
+			}
+		case 0x17: // Page Wait
+			// Ignore
+			control(0, nil)
+		case 0x18: // Escape Printer Control Codes
+			// Read until another 0x18
+			codes, err := readString(inDoc, 0x18)
+			if err != nil {
+				warning(err)
+			}
+			if len(codes) > 0 || err == nil {
+				// Keep what was read of unterminated codes
+				if p.KeepPrinterCodes && !inComment && !settings.HeaderCapture && !settings.FooterCapture {
+					out.text(codes)
+					lineText = true
+				}
+				control(0, codes)
+			}
+		case 0x19: // Lines per page
+			value, err := readNumber(3)
+			if err != nil {
+				warning(err)
+			} else {
+				settings.PageLength = value
+				control(value, nil)
+			}
+		default:
+			text, ok := p.printable(nextByte)
+			if !ok {
+				// Skip any unprintable bytes that have slipped through
+				if p.Trace != nil && p.LogLevel >= LogVerbose {
+					p.trace(codeOffset, nextByte, nil, 0)
+				}
+				continue
+			}
+			if settings.FooterCapture {
+				// Capture the footer
+				settings.Footer = capture("footer", settings.Footer, text)
+			} else if settings.HeaderCapture {
+				// Capture the header
+				settings.Header = capture("header", settings.Header, text)
+			} else if !inComment {
+				if p.NormalizeSpace {
+					// The run of spaces can carry on past control codes, but not a line end
+					text = collapseSpaces(text, lineText && afterSpace)
+				}
+				text = expandTabs(text, p.TabWidth)
+				if len(text) == 0 {
+					continue
+				}
+				afterSpace = text[len(text)-1] == ' '
+				if p.OnParagraph != nil {
+					if len(paragraphText) == 0 {
+						paragraphPage = settings.pageNumber(settings.Structure.Pages)
+						paragraphLine = settings.Structure.pageLines + 1
+					}
+					paragraphText = append(paragraphText, text...)
+				}
+				out.text(text)
+				settings.Structure.paragraphLen = settings.Structure.paragraphLen + len(text)
+				lineText = true
+			}
+		}
+	}
+	finishDocument(false)
+
+	return settings, nil
+}
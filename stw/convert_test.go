@@ -0,0 +1,158 @@
+package stw
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// errDisk is the error returned by failingReader
+var errDisk = errors.New("disk error")
+
+// failingReader - A reader that fails with errDisk
+type failingReader struct{}
+
+func (failingReader) Read(b []byte) (int, error) {
+	return 0, errDisk
+}
+
+func TestChainFile(t *testing.T) {
+	doc := append(append([]byte{}, Signature...), "Some text that links on.\x10\x16NEXT.DOC\x00"...)
+	p := Parser{LogLevel: LogQuiet}
+	settings, err := p.Parse(bytes.NewReader(doc), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(settings.ChainFile) != "NEXT.DOC" {
+		t.Errorf("ChainFile is %q, not %q", settings.ChainFile, "NEXT.DOC")
+	}
+}
+
+func TestRaggedFont(t *testing.T) {
+	doc := append(append([]byte{}, Signature...), "\x071Bold text\x13 2\x00"...)
+	p := Parser{LogLevel: LogQuiet, RaggedNumbers: true, Warning: func(err error) { t.Error(err) }}
+	var out bytes.Buffer
+	settings, err := p.Parse(bytes.NewReader(doc), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Structure.FontChanges[BoldFont] != 1 || settings.LineSpacing != 2 {
+		t.Errorf("font changes are %v and line spacing is %d, not 1 bold and 2", settings.Structure.FontChanges, settings.LineSpacing)
+	}
+	if want := "Bold text\n"; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("text is %q, not %q", out.String(), want)
+	}
+}
+
+func TestJSONSettings(t *testing.T) {
+	doc := append(append([]byte{}, Signature...), "\x08Page @ of \xe9t\xe9\x08Some text\x00"...)
+	p := Parser{LogLevel: LogQuiet, Format: "json"}
+	var out bytes.Buffer
+	if _, err := p.Parse(bytes.NewReader(doc), &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := `"header": "Page @ of été"`; !strings.Contains(out.String(), want) {
+		t.Errorf("%s is not in %s", want, out.String())
+	}
+}
+
+func TestSettingsMarshalJSON(t *testing.T) {
+	doc := append(append([]byte{}, Signature...), "\x08Page @\x08\x06The end\x06Some text\x00"...)
+	settings, err := ParseSettings(bytes.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["header"] != "Page @" || fields["footer"] != "The end" {
+		t.Errorf("the header and footer are %q and %q in %s", fields["header"], fields["footer"], data)
+	}
+}
+
+func TestSpeechPages(t *testing.T) {
+	doc := append(append([]byte{}, Signature...), "\x19  3One\x00Two\x00Three\x00Four\x00Five\x00Six\x00Seven\x00"...)
+	p := Parser{LogLevel: LogQuiet, Format: "speech"}
+	var out bytes.Buffer
+	if _, err := p.Parse(bytes.NewReader(doc), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "One\nTwo\nThree\nPage 2,\nFour\nFive\nSix\nPage 3,\nSeven\n"
+	if out.String() != want {
+		t.Errorf("speech is %q, not %q", out.String(), want)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	doc := append(append([]byte{}, Signature...), "Some text\x00"...)
+	p := Parser{LogLevel: LogQuiet, Format: "html", Provenance: map[string]string{
+		"source":    "A&B.DOC",
+		"generator": "convert-stw 1.0",
+	}}
+	var out bytes.Buffer
+	if _, err := p.Parse(bytes.NewReader(doc), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "<head>\n<meta charset=\"utf-8\">\n<meta name=\"generator\" content=\"convert-stw 1.0\">\n<meta name=\"source\" content=\"A&amp;B.DOC\">\n</head>\n"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("the head is not %q in %q", want, out.String())
+	}
+}
+
+func TestParseSettings(t *testing.T) {
+	doc := append(append([]byte{}, Signature...), "\x0c  5\x12 60\x08Page @\x08\x06The end\x06Some text\x07 9\x10\x16NEXT.DOC\x00"...)
+	settings, err := ParseSettings(bytes.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprintf("%d %d %q %q %q %d", settings.MarginLeft, settings.MarginRight, settings.Header, settings.Footer, settings.ChainFile, len(settings.Warnings))
+	if want := `5 60 "Page @" "The end" "NEXT.DOC" 1`; got != want {
+		t.Errorf("settings are %s, not %s", got, want)
+	}
+
+	if _, err := ParseSettings(bytes.NewReader([]byte("Not a STWriter file"))); err != ErrNoHeader {
+		t.Errorf("ParseSettings returned %v, not ErrNoHeader", err)
+	}
+}
+
+// justifiedDoc returns a justified document of paragraphs that are wrapped by ApplyMargins
+func justifiedDoc(paragraphs int) []byte {
+	doc := append(append([]byte{}, Signature...), "\x0c  5\x12 60\x0a 1"...)
+	return append(doc, strings.Repeat("The quick brown fox jumps over the lazy dog and keeps on running past the end of the line.\x10", paragraphs)...)
+}
+
+func TestLayoutAllocs(t *testing.T) {
+	p := Parser{LogLevel: LogQuiet, ApplyMargins: true}
+	allocs := func(doc []byte) float64 {
+		return testing.AllocsPerRun(3, func() {
+			if _, err := p.Parse(bytes.NewReader(doc), ioutil.Discard); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	// Only one line is held back for the layout, so the allocations do not grow with the document
+	small, large := allocs(justifiedDoc(10)), allocs(justifiedDoc(5000))
+	if large > small {
+		t.Errorf("%v allocations for 5000 paragraphs, %v for 10", large, small)
+	}
+}
+
+func TestReadError(t *testing.T) {
+	doc := append(append([]byte{}, Signature...), "Some text before the disk fails"...)
+	p := Parser{LogLevel: LogQuiet}
+	var out bytes.Buffer
+	_, err := p.Parse(io.MultiReader(bytes.NewReader(doc), failingReader{}), &out)
+	if !errors.Is(err, errDisk) {
+		t.Errorf("Parse returned %v, not the read error", err)
+	}
+}
@@ -0,0 +1,164 @@
+package stw
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Document - The parts of a STWriter document that Encode writes
+//
+// The settings that are 0 are left out of the document, so STWriter uses its
+// own defaults for them.
+type Document struct {
+	MarginTop        int
+	MarginBottom     int
+	MarginLeft       int
+	MarginRight      int
+	PageLength       int
+	StartPage        int
+	LineSpacing      int
+	ParagraphSpacing int
+	Indent           int    // Paragraph indent
+	Justified        bool   // Turn on justification
+	Charset          string // raw (the default) writes the text's bytes as they are, atari-st translates UTF-8 to the Atari ST characters
+	Header           string
+	Footer           string
+	Paragraphs       []Paragraph
+}
+
+// Paragraph - A paragraph of text runs, or a section heading when Heading is set
+//
+// Headings, centered and block right paragraphs only last until the end of the
+// line, so they are ended by a line end instead of Ctrl-P.
+type Paragraph struct {
+	Heading    int  // Section level from 1 to 9, 0 for a paragraph of text
+	Center     bool // Center the paragraph's line
+	BlockRight bool // Block right the paragraph's line
+	Runs       []Run
+}
+
+// Run - Text in one font, a newline in it is a line end
+type Run struct {
+	Font FontType
+	Text string
+}
+
+// encoder - Writes the control codes and text of a Document
+type encoder struct {
+	out     *bufio.Writer
+	charset string
+	font    FontType // The font the document is in
+	err     error    // The first problem with the Document
+}
+
+/* number writes a control code followed by its value in a field width bytes wide */
+func (e *encoder) number(code byte, value int, width int) {
+	field := fmt.Sprintf("%*d", width, value)
+	if len(field) > width {
+		if e.err == nil {
+			e.err = fmt.Errorf("ERROR: %d is too wide for control code 0x%02x, it has %d bytes", value, code, width)
+		}
+		return
+	}
+	e.out.WriteByte(code)
+	e.out.WriteString(field)
+}
+
+/* setting writes a control code and its value when the value is not 0 */
+func (e *encoder) setting(code byte, value int, width int) {
+	if value != 0 {
+		e.number(code, value, width)
+	}
+}
+
+/* text writes text, translating it to the character set and newlines to line ends */
+func (e *encoder) text(text string) {
+	for _, c := range text {
+		switch {
+		case c == '\n':
+			e.out.WriteByte(0x00)
+		case c >= 0x20 && c < 0x7f:
+			e.out.WriteByte(byte(c))
+		case e.charset == "atari-st":
+			b, ok := atariSTByte(c)
+			if !ok && e.err == nil {
+				e.err = fmt.Errorf("ERROR: %q is not in the Atari ST character set", c)
+			}
+			e.out.WriteByte(b)
+		case c < 0x20 || c > 0xff:
+			if e.err == nil {
+				e.err = fmt.Errorf("ERROR: %q cannot be written to a STWriter document", c)
+			}
+		default:
+			e.out.WriteByte(byte(c))
+		}
+	}
+}
+
+/* headerFooter writes a header or footer between a pair of its control code */
+func (e *encoder) headerFooter(code byte, text string) {
+	if len(text) == 0 {
+		return
+	}
+	e.out.WriteByte(code)
+	e.text(text)
+	e.out.WriteByte(code)
+}
+
+/* paragraph writes one paragraph, changing the font for each run */
+func (e *encoder) paragraph(para Paragraph) {
+	if para.Heading != 0 {
+		e.number(0x15, para.Heading, 1)
+	}
+	if para.Center {
+		e.out.WriteByte(0x03)
+	} else if para.BlockRight {
+		e.out.WriteString("\x03\x03")
+	}
+	for _, run := range para.Runs {
+		if run.Font != e.font {
+			e.number(0x07, int(run.Font), 2)
+			e.font = run.Font
+		}
+		e.text(run.Text)
+	}
+	if para.Heading != 0 || para.Center || para.BlockRight {
+		e.out.WriteByte(0x00)
+	} else {
+		e.out.WriteByte(0x10)
+	}
+}
+
+/* Encode writes doc as a STWriter document, the inverse of Convert for the formatting that both of them support */
+func Encode(w io.Writer, doc Document) error {
+	if len(doc.Charset) > 0 && doc.Charset != "raw" && doc.Charset != "atari-st" {
+		return fmt.Errorf("unknown character set %q", doc.Charset)
+	}
+	e := &encoder{out: bufio.NewWriter(w), charset: doc.Charset}
+	e.out.Write(Signature)
+	e.setting(0x19, doc.PageLength, 3)
+	e.setting(0x14, doc.MarginTop, 3)
+	e.setting(0x02, doc.MarginBottom, 3)
+	e.setting(0x0c, doc.MarginLeft, 3)
+	e.setting(0x12, doc.MarginRight, 3)
+	e.setting(0x11, doc.StartPage, 3)
+	e.setting(0x13, doc.LineSpacing, 2)
+	e.setting(0x04, doc.ParagraphSpacing, 2)
+	e.setting(0x09, doc.Indent, 2)
+	if doc.Justified {
+		e.number(0x0a, 1, 2)
+	}
+	e.headerFooter(0x08, doc.Header)
+	e.headerFooter(0x06, doc.Footer)
+	for _, para := range doc.Paragraphs {
+		if para.Heading < 0 || para.Heading > maxSectionLevel {
+			return fmt.Errorf("ERROR: section level %d is not from 1 to %d", para.Heading, maxSectionLevel)
+		}
+		e.paragraph(para)
+	}
+	if e.err != nil {
+		return e.err
+	}
+	return e.out.Flush()
+}
@@ -0,0 +1,114 @@
+package stw
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fuzzParsers are the option sets FuzzConvert parses each input with
+var fuzzParsers = []Parser{
+	{},
+	{ApplyMargins: true, ApplySpacing: true, CheckLineWidth: true},
+	{Format: "print"},
+	{Format: "print", PageHeaders: true, FormFeed: "pad"},
+	{RaggedNumbers: true, NumberHeadings: true, SectionIndent: 2},
+	{Format: "json", RaggedNumbers: true},
+	{Format: "html", KeepComments: true, KeepPrinterCodes: true},
+	{Format: "rtf", Charset: "atari-st"},
+	{Format: "markdown", PageMarkers: true},
+	{Format: "ansi", StripCR: true, NormalizeSpace: true, TabWidth: 4},
+	{ScanForHeader: true, SplitOnMarker: true, KeepPreamble: true},
+	{Strict: true},
+}
+
+// parseTimeout is how long one parse of a fuzzed input may take before it is treated as a hang
+const parseTimeout = 10 * time.Second
+
+/* fuzzParse parses data with p, failing when it panics or does not finish */
+func fuzzParse(t *testing.T, p Parser, data []byte) {
+	p.LogLevel = LogQuiet
+	p.Warning = func(err error) {}
+	done := make(chan interface{})
+	go func() {
+		defer func() {
+			done <- recover()
+		}()
+		p.Parse(bytes.NewReader(data), ioutil.Discard)
+	}()
+	select {
+	case r := <-done:
+		if r != nil {
+			t.Fatalf("%+v panicked on %q: %v", p, data, r)
+		}
+	case <-time.After(parseTimeout):
+		t.Fatalf("%+v did not finish parsing %q", p, data)
+	}
+}
+
+func FuzzConvert(f *testing.F) {
+	docs, err := filepath.Glob("../tests/*.doc")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, doc := range docs {
+		data, err := ioutil.ReadFile(doc)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add(append(append([]byte{}, Signature...), "\x0c-5 hello\x00"...))
+	f.Add(append(append([]byte{}, Signature...), "\x0d -3\x0e 20\x19  4\x14  1text\x10"...))
+	f.Add(append(append([]byte{}, Signature...), "\x1599999999 heading\x00\x15 12 heading\x00"...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, p := range fuzzParsers {
+			fuzzParse(t, p, data)
+		}
+	})
+}
+
+func FuzzEncode(f *testing.F) {
+	f.Add("The quick brown fox", 5, 60, 0)
+	f.Add("Indented  and  spaced", 0, 0, 3)
+
+	f.Fuzz(func(t *testing.T, text string, left, right, indent int) {
+		for _, c := range []byte(text) {
+			if c < 0x20 || c >= 0x7f {
+				t.Skip("Encode only writes printable ASCII as it is")
+			}
+		}
+		doc := Document{
+			MarginLeft:  left,
+			MarginRight: right,
+			Indent:      indent,
+			Paragraphs:  []Paragraph{{Runs: []Run{{Text: text}}}},
+		}
+		var encoded bytes.Buffer
+		if err := Encode(&encoded, doc); err != nil {
+			t.Skip(err)
+		}
+
+		p := Parser{LogLevel: LogQuiet, Warning: func(err error) {}}
+		var out bytes.Buffer
+		settings, err := p.Parse(&encoded, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if left < 0 {
+			// A negative left margin is used as 0
+			left = 0
+		}
+		got := fmt.Sprint(settings.MarginLeft, settings.MarginRight, settings.Indent)
+		if want := fmt.Sprint(left, right, indent); got != want {
+			t.Errorf("settings are %s, not %s", got, want)
+		}
+		if want := text + "\n\n"; out.String() != want {
+			t.Errorf("text is %q, not %q", out.String(), want)
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package stw
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+)
+
+// htmlRenderer - Writes the document as a minimal HTML page
+type htmlRenderer struct {
+	out      *bufio.Writer
+	settings *Settings
+	utf8     bool              // The text is UTF-8 instead of Latin-1
+	meta     map[string]string // The <meta> tags to write in the head
+
+	headingPending bool   // The next text starts a section heading
+	inParagraph    bool   // A <p> is open
+	lineBreak      bool   // The next line of the paragraph starts with a <br>
+	lineText       bool   // Something has been written on the current line
+	lineTag        string // The heading or div holding the current line
+	fontTag        string // The <b> or <i> that is open
+	inComment      bool   // The rest of the line is in an HTML comment
+	pages          int    // Pages that have been ejected
+}
+
+/* htmlEscape escapes the characters HTML would read as markup, and drops the control characters, the bytes above 0x7f are read as Latin-1 unless the text is UTF-8, since the page is always UTF-8 */
+func htmlEscape(text []byte, utf8 bool) []byte {
+	var escaped []byte
+	for _, b := range text {
+		switch {
+		case b == '<':
+			escaped = append(escaped, "&lt;"...)
+		case b == '>':
+			escaped = append(escaped, "&gt;"...)
+		case b == '&':
+			escaped = append(escaped, "&amp;"...)
+		case b >= 0x80 && !utf8:
+			escaped = append(escaped, fmt.Sprintf("&#%d;", b)...)
+		case b >= 0x20:
+			escaped = append(escaped, b)
+		}
+	}
+	return escaped
+}
+
+/* htmlFontTag returns the element for a STWriter font, or an empty string for the plain fonts */
+func htmlFontTag(font FontType) string {
+	switch font {
+	case BoldFont:
+		return "b"
+	case ItalicFont:
+		return "i"
+	}
+	return ""
+}
+
+/* startLine opens the element holding the line when the first text is written on it */
+func (r *htmlRenderer) startLine() {
+	if r.lineText {
+		return
+	}
+	if r.headingPending {
+		r.endParagraph()
+		level := r.settings.SectionLevel
+		if level < 1 {
+			level = 1
+		} else if level > 6 {
+			level = 6
+		}
+		r.lineTag = fmt.Sprintf("h%d", level)
+		fmt.Fprintf(r.out, "<%s>", r.lineTag)
+		r.headingPending = false
+	} else if r.settings.BlockRight {
+		r.endParagraph()
+		r.lineTag = "div"
+		r.out.WriteString(`<div style="text-align:right">`)
+	} else if r.settings.Center {
+		r.endParagraph()
+		r.lineTag = "div"
+		r.out.WriteString(`<div style="text-align:center">`)
+	} else if !r.inParagraph {
+		r.out.WriteString("<p>")
+		r.inParagraph = true
+	} else if r.lineBreak {
+		r.out.WriteString("<br>\n")
+	}
+	r.lineBreak = false
+	r.lineText = true
+}
+
+/* closeFont closes the open font element */
+func (r *htmlRenderer) closeFont() {
+	if len(r.fontTag) > 0 {
+		fmt.Fprintf(r.out, "</%s>", r.fontTag)
+		r.fontTag = ""
+	}
+}
+
+/* endLine closes the elements that only last until the end of the line */
+func (r *htmlRenderer) endLine() {
+	if r.inComment {
+		r.out.WriteString(" -->")
+		r.inComment = false
+	}
+	r.closeFont()
+	if len(r.lineTag) > 0 {
+		fmt.Fprintf(r.out, "</%s>\n", r.lineTag)
+		r.lineTag = ""
+	} else if r.lineText {
+		r.lineBreak = true
+	}
+	r.lineText = false
+}
+
+/* endParagraph closes the line and the paragraph it is in */
+func (r *htmlRenderer) endParagraph() {
+	r.endLine()
+	if r.inParagraph {
+		r.out.WriteString("</p>\n")
+		r.inParagraph = false
+	}
+	r.lineBreak = false
+}
+
+/* startDocument writes the start of the page, or a rule between documents */
+func (r *htmlRenderer) startDocument(documents, pages int) {
+	r.headingPending = false
+	r.pages = pages
+	if documents > 1 {
+		r.out.WriteString("<hr>\n")
+	} else {
+		r.out.WriteString("<!DOCTYPE html>\n<html>\n")
+		r.writeHead()
+		r.out.WriteString("<body>\n")
+	}
+}
+
+/* writeHead writes the head with the charset and the meta tags, in order of their names */
+func (r *htmlRenderer) writeHead() {
+	r.out.WriteString("<head>\n<meta charset=\"utf-8\">\n")
+	var names []string
+	for name := range r.meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(r.out, "<meta name=\"%s\" content=\"%s\">\n", html.EscapeString(name), html.EscapeString(r.meta[name]))
+	}
+	r.out.WriteString("</head>\n")
+}
+
+/* text writes printable text in the element for the current font */
+func (r *htmlRenderer) text(text []byte) {
+	r.startLine()
+	if !r.inComment {
+		if tag := htmlFontTag(r.settings.Font); tag != r.fontTag {
+			r.closeFont()
+			if len(tag) > 0 {
+				fmt.Fprintf(r.out, "<%s>", tag)
+			}
+			r.fontTag = tag
+		}
+	}
+	r.out.Write(htmlEscape(text, r.utf8))
+}
+
+/* lineEnd ends the line, a blank line ends the paragraph */
+func (r *htmlRenderer) lineEnd() {
+	if !r.lineText && r.inParagraph {
+		r.endParagraph()
+	} else {
+		r.endLine()
+	}
+}
+
+/* paragraph ends the paragraph */
+func (r *htmlRenderer) paragraph() {
+	r.endParagraph()
+}
+
+/* pageEject ends the page with its footer and asks for a page break when the page is printed */
+func (r *htmlRenderer) pageEject() {
+	r.endParagraph()
+	r.writeFooter()
+	r.out.WriteString("<div style=\"break-after:page\"></div>\n")
+	r.pages = r.pages + 1
+}
+
+/* fontChange closes the old font, the new one is opened with the next text */
+func (r *htmlRenderer) fontChange() {
+	r.closeFont()
+}
+
+/* heading ends the current line, the heading starts with the next text */
+func (r *htmlRenderer) heading() {
+	if r.lineText {
+		r.endLine()
+	}
+	r.headingPending = true
+}
+
+/* comment puts the rest of the line in an HTML comment */
+func (r *htmlRenderer) comment() {
+	r.startLine()
+	r.closeFont()
+	r.out.WriteString("<!-- ")
+	r.inComment = true
+}
+
+/* header writes the header in a header element, with the number of the current page for @ */
+func (r *htmlRenderer) header() {
+	r.endParagraph()
+	page := strconv.Itoa(r.settings.pageNumber(r.pages))
+	fmt.Fprintf(r.out, "<header>%s</header>\n", htmlEscape(pageText(r.settings.Header, page), r.utf8))
+}
+
+/* footer is written at the end of each page by writeFooter, not where Ctrl-F sets it */
+func (r *htmlRenderer) footer() {
+}
+
+/* writeFooter ends the page with the footer in a footer element, with the number of the page for @ */
+func (r *htmlRenderer) writeFooter() {
+	if len(r.settings.Footer) == 0 || r.settings.FooterCapture {
+		return
+	}
+	page := strconv.Itoa(r.settings.pageNumber(r.pages))
+	fmt.Fprintf(r.out, "<footer>%s</footer>\n", htmlEscape(pageText(r.settings.Footer, page), r.utf8))
+}
+
+/* endDocument closes the open elements and ends the last page with its footer, and the page after the last document */
+func (r *htmlRenderer) endDocument(more bool) {
+	r.endParagraph()
+	r.writeFooter()
+	if !more {
+		r.out.WriteString("</body>\n</html>\n")
+	}
+	r.out.Flush()
+}
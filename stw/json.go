@@ -0,0 +1,146 @@
+package stw
+
+import (
+	"bufio"
+	"encoding/json"
+)
+
+// Block - A run of text with the same formatting, written by the json format
+type Block struct {
+	Text         string   `json:"text"`
+	Font         FontType `json:"font"`
+	FontName     string   `json:"fontName"` // The font from FontType.String
+	Align        string   `json:"align"`    // left, center, right or justified
+	Indent       int      `json:"indent"`
+	SectionLevel int      `json:"sectionLevel"`
+	Comment      bool     `json:"comment,omitempty"` // The text is a Ctrl-K comment
+	End          string   `json:"end,omitempty"`     // line, paragraph or page when the block ends one
+}
+
+// jsonDocument - The blocks and settings of one document in the json format
+type jsonDocument struct {
+	Blocks   []Block  `json:"blocks"`
+	Settings Settings `json:"settings"`
+}
+
+// jsonRenderer - Collects the blocks of the document and writes them as JSON at the end
+type jsonRenderer struct {
+	out       *bufio.Writer
+	settings  *Settings
+	blocks    []Block
+	open      bool // The last block can have more text added to it
+	inComment bool // The rest of the line is a comment
+	utf8      bool // The text is UTF-8 instead of Latin-1
+}
+
+/* format returns an empty block with the current formatting */
+func (r *jsonRenderer) format() Block {
+	settings := r.settings
+	block := Block{
+		Font:         settings.Font,
+		FontName:     settings.Font.String(),
+		Align:        "left",
+		Indent:       settings.Indent,
+		SectionLevel: settings.SectionLevel,
+		Comment:      r.inComment,
+	}
+	if settings.BlockRight {
+		block.Align = "right"
+	} else if settings.Center {
+		block.Align = "center"
+	} else if settings.Justified {
+		block.Align = "justified"
+	}
+	return block
+}
+
+/* current returns the block for the text, starting a new one when the formatting has changed */
+func (r *jsonRenderer) current() *Block {
+	format := r.format()
+	if r.open {
+		last := &r.blocks[len(r.blocks)-1]
+		compare := *last
+		compare.Text = ""
+		if compare == format {
+			return last
+		}
+	}
+	r.blocks = append(r.blocks, format)
+	r.open = true
+	return &r.blocks[len(r.blocks)-1]
+}
+
+/* end marks the end of a line, paragraph or page on the last block */
+func (r *jsonRenderer) end(kind string) {
+	if !r.open {
+		r.blocks = append(r.blocks, r.format())
+	}
+	r.blocks[len(r.blocks)-1].End = kind
+	r.open = false
+	r.inComment = false
+}
+
+/* startDocument starts collecting the blocks of a new document */
+func (r *jsonRenderer) startDocument(documents, pages int) {
+	r.blocks = nil
+	r.open = false
+	r.inComment = false
+}
+
+/* text adds text to the current block, reading the bytes as Latin-1 unless they are UTF-8 */
+func (r *jsonRenderer) text(text []byte) {
+	block := r.current()
+	if r.utf8 {
+		block.Text = block.Text + string(text)
+		return
+	}
+	runes := []rune(block.Text)
+	for _, b := range text {
+		runes = append(runes, rune(b))
+	}
+	block.Text = string(runes)
+}
+
+/* lineEnd ends the block at the end of the line */
+func (r *jsonRenderer) lineEnd() {
+	r.end("line")
+}
+
+/* paragraph ends the block at the end of the paragraph */
+func (r *jsonRenderer) paragraph() {
+	r.end("paragraph")
+}
+
+/* pageEject ends the block at the end of the page */
+func (r *jsonRenderer) pageEject() {
+	r.end("page")
+}
+
+/* fontChange is recorded by the next block */
+func (r *jsonRenderer) fontChange() {
+}
+
+/* heading is recorded by the next block */
+func (r *jsonRenderer) heading() {
+}
+
+/* comment starts a comment block */
+func (r *jsonRenderer) comment() {
+	r.inComment = true
+}
+
+/* header is written with the settings */
+func (r *jsonRenderer) header() {
+}
+
+/* footer is written with the settings */
+func (r *jsonRenderer) footer() {
+}
+
+/* endDocument writes the blocks and the settings of the document */
+func (r *jsonRenderer) endDocument(more bool) {
+	enc := json.NewEncoder(r.out)
+	enc.SetIndent("", "  ")
+	enc.Encode(jsonDocument{Blocks: r.blocks, Settings: *r.settings})
+	r.out.Flush()
+}
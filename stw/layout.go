@@ -0,0 +1,209 @@
+package stw
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// layoutRun - A font change in the line held back by ApplyMargins
+type layoutRun struct {
+	offset int      // Offset in the line of the first byte in the font
+	font   FontType // The new font
+}
+
+/* runeOffset returns the number of bytes in the first n characters of text */
+func runeOffset(text []byte, n int) int {
+	offset := 0
+	for i := 0; i < n && offset < len(text); i++ {
+		_, size := utf8.DecodeRune(text[offset:])
+		offset = offset + size
+	}
+	return offset
+}
+
+/* nextPiece breaks the first piece that fits in width off a line at a space, a word wider than width gets a piece of its own, more is false when it was the last piece */
+func nextPiece(line []byte, width int) (piece, rest []byte, more bool) {
+	if width <= 0 || utf8.RuneCount(line) <= width {
+		return line, nil, false
+	}
+	start := len(line) - len(bytes.TrimLeft(line, " "))
+	end := bytes.LastIndexByte(line[:runeOffset(line, width+1)], ' ')
+	if end <= start {
+		// The first word does not fit, break after it
+		end = bytes.IndexByte(line[start:], ' ')
+		if end < 0 {
+			return line, nil, false
+		}
+		end = start + end
+	}
+	return bytes.TrimRight(line[:end], " "), bytes.TrimLeft(line[end:], " "), true
+}
+
+/* wordAt returns the start and end of the first word in text at or after offset, start is len(text) when there are no more words */
+func wordAt(text []byte, offset int) (start, end int) {
+	start = offset
+	for start < len(text) && (text[start] == ' ' || text[start] == '\t') {
+		start = start + 1
+	}
+	end = start
+	for end < len(text) && text[end] != ' ' && text[end] != '\t' {
+		end = end + 1
+	}
+	return start, end
+}
+
+/* longestWord returns the length of the longest word in text */
+func longestWord(text []byte) int {
+	longest := 0
+	for start, end := wordAt(text, 0); start < len(text); start, end = wordAt(text, end) {
+		if n := utf8.RuneCount(text[start:end]); n > longest {
+			longest = n
+		}
+	}
+	return longest
+}
+
+/* alignLine returns the part of a piece of a line to write, and the spaces before it that center or block right it within width */
+func alignLine(piece []byte, width int, settings *Settings) (start, end, pad int) {
+	if !settings.Center && !settings.BlockRight {
+		return 0, len(piece), 0
+	}
+	start = len(piece) - len(bytes.TrimLeft(piece, " "))
+	end = start + len(bytes.TrimRight(piece[start:], " "))
+	pad = width - utf8.RuneCount(piece[start:end])
+	if pad <= 0 {
+		return start, end, 0
+	}
+	if settings.Center {
+		pad = pad / 2
+	}
+	return start, end, pad
+}
+
+/* justifyGaps returns the spaces that fill a piece of a line out to width and the gaps between its words they are spread over, ok is false when it cannot be justified */
+func justifyGaps(piece []byte, width int) (spaces, gaps int, ok bool) {
+	words := 0
+	spaces = width
+	for start, end := wordAt(piece, 0); start < len(piece); start, end = wordAt(piece, end) {
+		if words == 0 {
+			// The spaces before the first word stay as they are
+			spaces = spaces - start
+		}
+		spaces = spaces - utf8.RuneCount(piece[start:end])
+		words = words + 1
+	}
+	gaps = words - 1
+	return spaces, gaps, words >= 2 && spaces >= gaps
+}
+
+/* firstLineIndent returns the Ctrl-I indent of the first line of a paragraph, leaving at least one character of width for the text */
+func firstLineIndent(settings *Settings, width int) int {
+	if settings.Center || settings.BlockRight {
+		return 0
+	}
+	indent := settings.Indent
+	if indent > width-1 {
+		indent = width - 1
+	}
+	if indent < 0 {
+		indent = 0
+	}
+	return indent
+}
+
+/* writeSpaces writes n spaces */
+func (r *textRenderer) writeSpaces(n int) {
+	for i := 0; i < n; i++ {
+		r.out.WriteByte(' ')
+	}
+}
+
+/* writeFonts writes the font changes held back with the line up to offset */
+func (r *textRenderer) writeFonts(offset int) {
+	for r.nextRun < len(r.runs) && r.runs[r.nextRun].offset <= offset {
+		r.out.WriteString(ansiFont(r.runs[r.nextRun].font))
+		r.nextRun = r.nextRun + 1
+	}
+}
+
+/* writeRuns writes text from offset in the line held back by ApplyMargins, with the font changes that were made in it */
+func (r *textRenderer) writeRuns(text []byte, offset int) {
+	for len(text) > 0 {
+		r.writeFonts(offset)
+		n := len(text)
+		if r.nextRun < len(r.runs) && r.runs[r.nextRun].offset < offset+n {
+			n = r.runs[r.nextRun].offset - offset
+		}
+		r.out.Write(text[:n])
+		text = text[n:]
+		offset = offset + n
+	}
+}
+
+/* writeJustified writes a piece of a line from offset with its words spread out by extra spaces so it fills width */
+func (r *textRenderer) writeJustified(piece []byte, offset, width int) {
+	spaces, gaps, ok := justifyGaps(piece, width)
+	if !ok {
+		r.writeRuns(piece, offset)
+		return
+	}
+	start, end := wordAt(piece, 0)
+	r.writeRuns(piece[:end], offset)
+	for i := 1; i <= gaps; i++ {
+		gap := spaces / gaps
+		if i <= spaces%gaps {
+			gap = gap + 1
+		}
+		r.writeSpaces(gap)
+		start, end = wordAt(piece, end)
+		r.writeRuns(piece[start:end], offset+start)
+	}
+}
+
+/* writeLayout is the second pass over the line held back by ApplyMargins, once all of its words and font changes are known it is wrapped at the right margin, justified or aligned, and indented by the left margin and the first line indent */
+func (r *textRenderer) writeLayout() {
+	settings := r.settings
+	line := r.line
+	for more := true; more; {
+		left, right := r.margins()
+		width := right - left
+		if r.firstLine && len(line) > 0 {
+			indent := firstLineIndent(settings, width)
+			left = left + indent
+			width = width - indent
+			r.firstLine = false
+		}
+		offset := len(r.line) - len(line)
+		var piece []byte
+		piece, line, more = nextPiece(line, width)
+		start, end, pad := alignLine(piece, width, settings)
+		if end > start {
+			r.out.WriteString(r.indent)
+			r.writeSpaces(left + pad)
+			if settings.Justified && more && !settings.Center && !settings.BlockRight {
+				// The last piece ends the paragraph and stays left aligned
+				r.writeJustified(piece, offset, width)
+			} else {
+				r.writeRuns(piece[start:end], offset+start)
+			}
+			if r.p.ColumnOrder != nil {
+				column := 1
+				if r.secondColumn {
+					column = 2
+				}
+				fmt.Fprintf(r.p.ColumnOrder, "Page %d\tColumn %d\tLine %d\t%s\n", r.settings.pageNumber(r.pages), column, r.pageLines+1, piece[start:end])
+			}
+		}
+		r.longestWord = longestWord(piece)
+		if more {
+			// The line can fill the first column and carry on in the second
+			r.lineFeed(r.spacingLines())
+			r.startPage()
+		}
+	}
+	r.writeFonts(len(r.line))
+	r.line = r.line[:0]
+	r.runs = r.runs[:0]
+	r.nextRun = 0
+}
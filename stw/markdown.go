@@ -0,0 +1,37 @@
+package stw
+
+import "strings"
+
+/* markdownHeading returns the # marker for a section level, markdown only has 6 levels */
+func markdownHeading(level int) string {
+	if level < 1 {
+		level = 1
+	} else if level > 6 {
+		level = 6
+	}
+	return strings.Repeat("#", level) + " "
+}
+
+/* markdownEmphasis returns the emphasis marker for a STWriter font */
+func markdownEmphasis(font FontType) string {
+	switch font {
+	case BoldFont:
+		return "**"
+	case ItalicFont:
+		return "*"
+	}
+	return ""
+}
+
+/* markdownEscape escapes a byte that markdown would read as markup, lineStart is true at the start of a line */
+func markdownEscape(b byte, lineStart bool) []byte {
+	switch b {
+	case '\\', '`', '*', '_', '[', ']', '<', '>':
+		return []byte{'\\', b}
+	case '#', '-', '+', '=':
+		if lineStart {
+			return []byte{'\\', b}
+		}
+	}
+	return []byte{b}
+}
@@ -0,0 +1,39 @@
+package stw
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// renderer - Writes a document in one output format while the Parser reads it
+//
+// The Parser updates the settings before calling the renderer, so the renderer
+// reads the current font, alignment and margins from them.
+type renderer interface {
+	startDocument(documents, pages int) // Starts document number documents after the settings are reset, or carries it on after pages in the writer from SplitPage
+	text(text []byte)                   // Writes printable text
+	lineEnd()                           // Ctrl-@ ends the line
+	paragraph()                         // Ctrl-P ends the paragraph
+	pageEject()                         // Ctrl-E ejects the page
+	fontChange()                        // Ctrl-G has changed settings.Font
+	heading()                           // Ctrl-U has set settings.SectionLevel, the heading text follows
+	comment()                           // Ctrl-K starts a comment that runs until the end of the line
+	header()                            // Ctrl-H has finished settings.Header, or a page from SplitPage starts
+	footer()                            // Ctrl-F has finished settings.Footer, or a page from SplitPage ends
+	endDocument(more bool)              // Finishes the document, more is true when another one follows
+}
+
+/* newRenderer returns the renderer for the Parser's output format */
+func (p *Parser) newRenderer(w *bufio.Writer, settings *Settings) (renderer, error) {
+	switch p.format() {
+	case "text", "print", "ansi", "speech", "troff", "markdown":
+		return newTextRenderer(p, w, settings), nil
+	case "html":
+		return &htmlRenderer{out: w, settings: settings, utf8: p.charset() == "atari-st", meta: p.Provenance}, nil
+	case "rtf":
+		return &rtfRenderer{out: w, settings: settings, utf8: p.charset() == "atari-st"}, nil
+	case "json":
+		return &jsonRenderer{out: w, settings: settings, utf8: p.charset() == "atari-st"}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", p.Format)
+}
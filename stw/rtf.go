@@ -0,0 +1,260 @@
+package stw
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// RTF measures in twips, STWriter in pica columns and lines of 6 per inch
+const (
+	rtfColumn     = 144
+	rtfLine       = 240
+	rtfPaperWidth = 12240
+)
+
+// rtfPageField is the field the word processor replaces with the page number
+const rtfPageField = `{\field{\*\fldinst PAGE}}`
+
+// rtfRenderer - Writes the document as RTF for word processors
+type rtfRenderer struct {
+	out      *bufio.Writer
+	settings *Settings
+	utf8     bool // The text is UTF-8 instead of single bytes
+
+	formatted      bool     // The document formatting has been written
+	headingPending bool     // The next text starts a section heading
+	inParagraph    bool     // A paragraph has been started
+	lineBreak      bool     // The next line of the paragraph starts with a \line
+	lineText       bool     // Something has been written on the current line
+	lineParagraph  bool     // The current line is a paragraph of its own
+	font           FontType // The font the RTF is using
+	inComment      bool     // The rest of the line is hidden text
+}
+
+/* rtfEscape escapes the RTF special characters and the characters outside of ASCII, writing UTF-8 text as unicode characters */
+func rtfEscape(text []byte, isUTF8 bool) []byte {
+	var escaped []byte
+	if isUTF8 {
+		for _, c := range string(text) {
+			if c > 0x7e {
+				escaped = append(escaped, fmt.Sprintf(`\u%d?`, c)...)
+			} else {
+				escaped = append(escaped, rtfEscape([]byte{byte(c)}, false)...)
+			}
+		}
+		return escaped
+	}
+	for _, b := range text {
+		switch {
+		case b == '\\' || b == '{' || b == '}':
+			escaped = append(escaped, '\\', b)
+		case b > 0x7e:
+			escaped = append(escaped, fmt.Sprintf(`\'%02x`, b)...)
+		case b >= 0x20:
+			escaped = append(escaped, b)
+		}
+	}
+	return escaped
+}
+
+/* rtfFont returns the control words that turn a STWriter font on and off */
+func rtfFont(font FontType) (string, string) {
+	switch font {
+	case BoldFont:
+		return `\b `, `\b0 `
+	case ItalicFont:
+		return `\i `, `\i0 `
+	case CondensedFont:
+		return `\fs16 `, `\fs24 `
+	case EliteFont:
+		return `\fs20 `, `\fs24 `
+	}
+	return "", ""
+}
+
+/* documentFormat writes the page size and margins once the document has set them */
+func (r *rtfRenderer) documentFormat() {
+	if r.formatted {
+		return
+	}
+	settings := r.settings
+	if settings.PageLength > 0 {
+		fmt.Fprintf(r.out, `\paperh%d`, settings.PageLength*rtfLine)
+	}
+	if settings.MarginLeft > 0 {
+		fmt.Fprintf(r.out, `\margl%d`, settings.MarginLeft*rtfColumn)
+	}
+	if settings.MarginRight > 0 && settings.MarginRight*rtfColumn < rtfPaperWidth {
+		fmt.Fprintf(r.out, `\margr%d`, rtfPaperWidth-settings.MarginRight*rtfColumn)
+	}
+	if settings.MarginTop > 0 {
+		fmt.Fprintf(r.out, `\margt%d`, settings.MarginTop*rtfLine)
+	}
+	if settings.MarginBottom > 0 {
+		fmt.Fprintf(r.out, `\margb%d`, settings.MarginBottom*rtfLine)
+	}
+	if settings.StartPageNum != 0 {
+		fmt.Fprintf(r.out, `\pgnstart%d\pgnrestart`, settings.StartPageNum)
+	}
+	r.out.WriteString("\n")
+	r.formatted = true
+}
+
+/* startParagraph writes the paragraph formatting, with an alignment for the whole paragraph */
+func (r *rtfRenderer) startParagraph(align string) {
+	settings := r.settings
+	r.out.WriteString(`\pard` + align)
+	if settings.LineSpacing > 1 {
+		fmt.Fprintf(r.out, `\sl%d\slmult1`, settings.LineSpacing*rtfLine)
+	}
+	if settings.ParagraphSpacing > 0 {
+		fmt.Fprintf(r.out, `\sa%d`, settings.ParagraphSpacing*rtfLine)
+	}
+	r.out.WriteString(" ")
+	r.inParagraph = true
+}
+
+/* startLine starts a paragraph for the line when the first text is written on it */
+func (r *rtfRenderer) startLine() {
+	if r.lineText {
+		return
+	}
+	r.documentFormat()
+	if r.headingPending {
+		r.endParagraph()
+		r.startParagraph(fmt.Sprintf(`\outlinelevel%d`, r.settings.SectionLevel-1))
+		r.lineParagraph = true
+		r.headingPending = false
+	} else if r.settings.BlockRight {
+		r.endParagraph()
+		r.startParagraph(`\qr`)
+		r.lineParagraph = true
+	} else if r.settings.Center {
+		r.endParagraph()
+		r.startParagraph(`\qc`)
+		r.lineParagraph = true
+	} else if !r.inParagraph {
+		if r.settings.Justified {
+			r.startParagraph(`\qj`)
+		} else {
+			r.startParagraph(`\ql`)
+		}
+	} else if r.lineBreak {
+		r.out.WriteString("\\line\n")
+	}
+	r.lineBreak = false
+	r.lineText = true
+}
+
+/* endLine ends the hidden comment, and the paragraph when the line is one of its own */
+func (r *rtfRenderer) endLine() {
+	if r.inComment {
+		r.out.WriteString("}")
+		r.inComment = false
+	}
+	if r.lineParagraph {
+		r.out.WriteString("\\par\n")
+		r.lineParagraph = false
+		r.inParagraph = false
+	} else if r.lineText {
+		r.lineBreak = true
+	}
+	r.lineText = false
+}
+
+/* endParagraph ends the line and the paragraph it is in */
+func (r *rtfRenderer) endParagraph() {
+	r.endLine()
+	if r.inParagraph {
+		r.out.WriteString("\\par\n")
+		r.inParagraph = false
+	}
+	r.lineBreak = false
+}
+
+/* startDocument writes the RTF header, or a section break between documents */
+func (r *rtfRenderer) startDocument(documents, pages int) {
+	r.headingPending = false
+	if documents > 1 {
+		r.out.WriteString("\\sect\\sectd\n")
+		r.formatted = true
+	} else {
+		r.out.WriteString("{\\rtf1\\ansi\\deff0{\\fonttbl{\\f0\\fmodern Courier New;}}\\f0\\fs24\n")
+	}
+}
+
+/* text writes printable text */
+func (r *rtfRenderer) text(text []byte) {
+	r.startLine()
+	r.out.Write(rtfEscape(text, r.utf8))
+}
+
+/* lineEnd ends the line, a blank line ends the paragraph */
+func (r *rtfRenderer) lineEnd() {
+	if !r.lineText && r.inParagraph {
+		r.endParagraph()
+	} else {
+		r.endLine()
+	}
+}
+
+/* paragraph ends the paragraph */
+func (r *rtfRenderer) paragraph() {
+	r.endParagraph()
+}
+
+/* pageEject starts a new page */
+func (r *rtfRenderer) pageEject() {
+	r.endParagraph()
+	r.documentFormat()
+	r.out.WriteString("\\page\n")
+}
+
+/* fontChange turns off the old font and turns on the new one */
+func (r *rtfRenderer) fontChange() {
+	if r.settings.Font == r.font {
+		return
+	}
+	_, off := rtfFont(r.font)
+	on, _ := rtfFont(r.settings.Font)
+	r.out.WriteString(off + on)
+	r.font = r.settings.Font
+}
+
+/* heading ends the current line, the heading paragraph starts with the next text */
+func (r *rtfRenderer) heading() {
+	if r.lineText {
+		r.endLine()
+	}
+	r.headingPending = true
+}
+
+/* comment hides the rest of the line */
+func (r *rtfRenderer) comment() {
+	r.startLine()
+	r.out.WriteString(`{\v `)
+	r.inComment = true
+}
+
+/* header writes the page header, with a page number field for @ */
+func (r *rtfRenderer) header() {
+	r.endParagraph()
+	r.documentFormat()
+	fmt.Fprintf(r.out, "{\\header\\pard\\qc %s\\par}\n", pageText(rtfEscape(r.settings.Header, r.utf8), rtfPageField))
+}
+
+/* footer writes the page footer, with a page number field for @ */
+func (r *rtfRenderer) footer() {
+	r.endParagraph()
+	r.documentFormat()
+	fmt.Fprintf(r.out, "{\\footer\\pard\\qc %s\\par}\n", pageText(rtfEscape(r.settings.Footer, r.utf8), rtfPageField))
+}
+
+/* endDocument ends the last paragraph, and the RTF after the last document */
+func (r *rtfRenderer) endDocument(more bool) {
+	r.endParagraph()
+	if !more {
+		r.out.WriteString("}\n")
+	}
+	r.out.Flush()
+}
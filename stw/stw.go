@@ -0,0 +1,489 @@
+// Package stw converts Atari STWriter documents into text
+package stw
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Signature is the marker that comes before the document in every STWriter file
+var Signature = []byte("Do Run Run STWRITER.PRG\x00")
+
+// ErrNoHeader is returned when the input does not have the Signature, so it is not a STWriter file
+var ErrNoHeader = errors.New("not a STWriter file: header signature not found")
+
+// ErrTooLarge is returned when the input is longer than the Parser's MaxBytes
+var ErrTooLarge = errors.New("input is longer than the maximum size")
+
+// maxStringLen is the longest header, footer or string after a control code that is kept
+const maxStringLen = 4096
+
+// maxNumberDigits is the most digits readIntUntil reads, the fixed width numbers have 3 at most
+const maxNumberDigits = 6
+
+// maxSectionLevel is the deepest section heading level
+const maxSectionLevel = 9
+
+// Warning - A problem the conversion carried on past, the settings keep a list of them
+type Warning struct {
+	Offset  int64  `json:"offset"` // Input offset of the control code, -1 when it is not about one
+	Code    byte   `json:"code"`   // The control code
+	Message string `json:"message"`
+	err     error
+}
+
+/* newWarning returns the Warning for err, about the control code at offset or -1 */
+func newWarning(offset int64, code byte, err error) Warning {
+	return Warning{Offset: offset, Code: code, Message: err.Error(), err: err}
+}
+
+func (w Warning) Error() string {
+	if w.Offset < 0 {
+		return w.Message
+	}
+	return fmt.Sprintf("at offset 0x%X: %s", w.Offset, w.Message)
+}
+
+func (w Warning) Unwrap() error {
+	return w.err
+}
+
+// headerSniffSize is how far into the input the Signature is looked for, unless the Parser's ScanForHeader is set
+const headerSniffSize = 4096
+
+// FontType - Supported font types
+type FontType int
+
+// Fonts selected by Ctrl-G, the numbers are the ones in the document and 3 is not used
+const (
+	PicaFont      FontType = 0
+	BoldFont      FontType = 1
+	CondensedFont FontType = 2
+	ItalicFont    FontType = 4
+	EliteFont     FontType = 5
+)
+
+// fontNames - The names of the fonts, font numbers that are not in it have no font
+var fontNames = map[FontType]string{
+	PicaFont:      "pica",
+	BoldFont:      "bold",
+	CondensedFont: "condensed",
+	ItalicFont:    "italic",
+	EliteFont:     "elite",
+}
+
+/* String returns the name of the font, or font and the number for the numbers that are not a font */
+func (font FontType) String() string {
+	if name, ok := fontNames[font]; ok {
+		return name
+	}
+	return "font " + strconv.Itoa(int(font))
+}
+
+/* ParseFontType returns the font for a name from String or a font number */
+func ParseFontType(name string) (FontType, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for font, fontName := range fontNames {
+		if name == fontName {
+			return font, nil
+		}
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(name, "font "))
+	if err != nil {
+		return PicaFont, fmt.Errorf("%q is not a font name or number", name)
+	}
+	return FontType(n), nil
+}
+
+// LogLevel - How much the Parser logs about the conversion, warnings are reported at every level
+type LogLevel int
+
+// Log levels, the default is LogInfo
+const (
+	LogQuiet   LogLevel = -1 // Only warnings
+	LogInfo    LogLevel = 0  // The header search, headers, footers and chained files
+	LogVerbose LogLevel = 1  // Each control code as well
+)
+
+// Settings - The document settings set by the control codes
+type Settings struct {
+	MarginTop        int       `json:"marginTop"`
+	MarginBottom     int       `json:"marginBottom"`
+	MarginLeft       int       `json:"marginLeft"`
+	MarginRight      int       `json:"marginRight"`
+	MarginLeft2      int       `json:"marginLeft2"`
+	MarginRight2     int       `json:"marginRight2"`
+	PageLength       int       `json:"pageLength"`
+	Indent           int       `json:"indent"`
+	Font             FontType  `json:"font"`
+	HeaderCapture    bool      `json:"-"`
+	Header           []byte    `json:"header"`
+	FooterCapture    bool      `json:"-"`
+	Footer           []byte    `json:"footer"`
+	Center           bool      `json:"-"`
+	BlockRight       bool      `json:"-"`
+	Justified        bool      `json:"justified"`
+	StartPageNum     int       `json:"startPageNum"`
+	LineSpacing      int       `json:"lineSpacing"`
+	ParagraphSpacing int       `json:"paragraphSpacing"`
+	SectionLevel     int       `json:"sectionLevel"`
+	ChainFile        []byte    `json:"chainFile"`
+	PrinterCodes     []int     `json:"printerCodes"` // Ctrl-O printer control codes in the order they were used
+	Preamble         []byte    `json:"preamble"`     // The bytes before the header, kept by the Parser's KeepPreamble
+	Warnings         []Warning `json:"warnings"`     // The problems the conversion carried on past
+	Structure        Structure `json:"structure"`
+}
+
+// Structure - Counts of the line and paragraph breaks, pages and formatting in the document
+type Structure struct {
+	LineEnds       int              `json:"lineEnds"`       // 0x00 codes
+	ParagraphEnds  int              `json:"paragraphEnds"`  // 0x10 codes
+	Paragraphs     int              `json:"paragraphs"`     // Paragraphs containing text
+	ParagraphChars int              `json:"paragraphChars"` // Characters in all of the paragraphs
+	PageEjects     int              `json:"pageEjects"`     // 0x05 codes
+	Pages          int              `json:"pages"`          // Pages ended by 0x05 or by filling the page length
+	CenteredLines  int              `json:"centeredLines"`  // Lines ended while centered by 0x03
+	FontChanges    map[FontType]int `json:"fontChanges"`    // 0x07 codes for each font
+	paragraphLen   int              // Characters in the current paragraph
+	pageLines      int              // Lines on the current page
+}
+
+/* averageParagraph returns the average number of characters in a paragraph */
+func (s *Structure) averageParagraph() int {
+	if s.Paragraphs == 0 {
+		return 0
+	}
+	return s.ParagraphChars / s.Paragraphs
+}
+
+/* endParagraph counts the current paragraph if it has any text in it */
+func (s *Structure) endParagraph() {
+	if s.paragraphLen > 0 {
+		s.Paragraphs = s.Paragraphs + 1
+		s.ParagraphChars = s.ParagraphChars + s.paragraphLen
+		s.paragraphLen = 0
+	}
+}
+
+/* addLines counts lines on the page, starting a new page when they reach bodyLines */
+func (s *Structure) addLines(lines, bodyLines int) {
+	s.pageLines = s.pageLines + lines
+	if bodyLines > 0 && s.pageLines >= bodyLines {
+		s.endPage()
+	}
+}
+
+/* endPage counts the current page */
+func (s *Structure) endPage() {
+	s.Pages = s.Pages + 1
+	s.pageLines = 0
+}
+
+/* addFont counts a change to font */
+func (s *Structure) addFont(font FontType) {
+	if s.FontChanges == nil {
+		s.FontChanges = map[FontType]int{}
+	}
+	s.FontChanges[font] = s.FontChanges[font] + 1
+}
+
+/* finish counts the last paragraph and page at the end of the document */
+func (s *Structure) finish() {
+	if s.pageLines > 0 || s.paragraphLen > 0 {
+		s.endPage()
+	}
+	s.endParagraph()
+}
+
+/* pageNumber returns the number of the page after pages have been printed, honoring StartPageNum */
+func (settings *Settings) pageNumber(pages int) int {
+	if settings.StartPageNum == 0 {
+		return pages + 1
+	}
+	return settings.StartPageNum + pages
+}
+
+/* bodyLines returns the lines of text that fit on a page between the margins and the reserved header and footer lines, or 0 when the page length is not set */
+func (settings *Settings) bodyLines(reserved int) int {
+	if settings.PageLength <= 0 {
+		return 0
+	}
+	if lines := settings.PageLength - settings.MarginTop - settings.MarginBottom - reserved; lines > 0 {
+		return lines
+	}
+	return 0
+}
+
+/* lineSpacing returns the line spacing, a spacing of 0 is single spaced */
+func (settings *Settings) lineSpacing() int {
+	if settings.LineSpacing < 1 {
+		return 1
+	}
+	return settings.LineSpacing
+}
+
+/* paragraphSpacing returns the blank lines after a paragraph, a spacing of 0 leaves one blank line */
+func (settings *Settings) paragraphSpacing() int {
+	if settings.ParagraphSpacing < 1 {
+		return 1
+	}
+	return settings.ParagraphSpacing
+}
+
+/* pageText replaces each @ in a header or footer with the page number, @@ is a literal @ */
+func pageText(text []byte, page string) []byte {
+	var replaced []byte
+	for i := 0; i < len(text); i++ {
+		if text[i] != '@' {
+			replaced = append(replaced, text[i])
+		} else if i+1 < len(text) && text[i+1] == '@' {
+			replaced = append(replaced, '@')
+			i = i + 1
+		} else {
+			replaced = append(replaced, page...)
+		}
+	}
+	return replaced
+}
+
+/* reportString escapes line breaks so a field stays on one line */
+func reportString(field []byte) string {
+	return strings.NewReplacer("\r", `\r`, "\n", `\n`).Replace(string(field))
+}
+
+/* jsonString returns a settings field as text, UTF-8 as it is and other bytes read as Latin-1 */
+func jsonString(field []byte) string {
+	if utf8.Valid(field) {
+		return string(field)
+	}
+	runes := make([]rune, len(field))
+	for i, b := range field {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+/* MarshalJSON writes the settings with the header, footer, chained file and preamble as strings, encoding/json would write them as base64 */
+func (settings Settings) MarshalJSON() ([]byte, error) {
+	// jsonSettings does not have the MarshalJSON method, so it is encoded as a plain struct
+	type jsonSettings Settings
+	return json.Marshal(struct {
+		jsonSettings
+		Header    string `json:"header"`
+		Footer    string `json:"footer"`
+		ChainFile string `json:"chainFile"`
+		Preamble  string `json:"preamble"`
+	}{
+		jsonSettings: jsonSettings(settings),
+		Header:       jsonString(settings.Header),
+		Footer:       jsonString(settings.Footer),
+		ChainFile:    jsonString(settings.ChainFile),
+		Preamble:     jsonString(settings.Preamble),
+	})
+}
+
+/* joinInts returns a comma separated list of numbers */
+func joinInts(values []int) string {
+	var s []string
+	for _, v := range values {
+		s = append(s, strconv.Itoa(v))
+	}
+	return strings.Join(s, ", ")
+}
+
+/* String returns the report of the document settings that is printed by -settings */
+func (settings Settings) String() string {
+	var b strings.Builder
+	b.WriteString("Document Settings\n=================\n")
+	fmt.Fprintf(&b, "Margins:\n    Top       : %d\n    Bottom    : %d\n    Left      : %d\n    Right     : %d\n\n",
+		settings.MarginTop, settings.MarginBottom, settings.MarginLeft, settings.MarginRight)
+	fmt.Fprintf(&b, "Column2:\n    Left      : %d\n    Right     : %d\n\n",
+		settings.MarginLeft2, settings.MarginRight2)
+	fmt.Fprintf(&b, "Page Length   : %d\n", settings.PageLength)
+	fmt.Fprintf(&b, "Starting Page : %d\n", settings.StartPageNum)
+	fmt.Fprintf(&b, "Font          : %s\n\n", settings.Font)
+	fmt.Fprintf(&b, "Header        : %s\n", reportString(settings.Header))
+	fmt.Fprintf(&b, "Footer        : %s\n\n", reportString(settings.Footer))
+	b.WriteString("Spacing\n")
+	fmt.Fprintf(&b, "    Line      : %d\n", settings.LineSpacing)
+	fmt.Fprintf(&b, "    Paragraph : %d\n\n", settings.ParagraphSpacing)
+	b.WriteString("Structure\n")
+	fmt.Fprintf(&b, "    Line ends (0x00)      : %d\n", settings.Structure.LineEnds)
+	fmt.Fprintf(&b, "    Paragraph ends (0x10) : %d\n", settings.Structure.ParagraphEnds)
+	fmt.Fprintf(&b, "    Paragraphs            : %d\n", settings.Structure.Paragraphs)
+	fmt.Fprintf(&b, "    Average paragraph     : %d characters\n\n", settings.Structure.averageParagraph())
+	fmt.Fprintf(&b, "Chained file  : %s\n", reportString(settings.ChainFile))
+	fmt.Fprintf(&b, "Printer codes : %s\n", joinInts(settings.PrinterCodes))
+	if len(settings.Preamble) > 0 {
+		fmt.Fprintf(&b, "Preamble      : %q\n", settings.Preamble)
+	}
+	return b.String()
+}
+
+// countingReader - Counts the bytes read so the parser can report where problems are
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	limit int64 // Bytes that can still be read, -1 when there is no limit
+}
+
+/* Read reads from the wrapped reader and counts the bytes, returning ErrTooLarge when there is more input than the limit */
+func (c *countingReader) Read(b []byte) (int, error) {
+	if c.limit == 0 {
+		// Only an error if there is more to read
+		var probe [1]byte
+		if n, err := c.r.Read(probe[:]); n == 0 {
+			return 0, err
+		}
+		return 0, ErrTooLarge
+	}
+	if c.limit > 0 && int64(len(b)) > c.limit {
+		b = b[:c.limit]
+	}
+	n, err := c.r.Read(b)
+	c.n = c.n + int64(n)
+	if c.limit > 0 {
+		c.limit = c.limit - int64(n)
+	}
+	return n, err
+}
+
+/* readUntil reads bytes until the expected string is matched, backtracking to the longest partial match on a mismatch, returns io.EOF when there is no match, the bytes before the match are appended to skipped when it is not nil */
+func readUntil(fin *bufio.Reader, match []byte, skipped *[]byte) error {
+	// fail[i] is the length of the longest prefix of match that is also a suffix of match[:i+1]
+	fail := make([]int, len(match))
+	for i, k := 1, 0; i < len(match); i++ {
+		for k > 0 && match[i] != match[k] {
+			k = fail[k-1]
+		}
+		if match[i] == match[k] {
+			k = k + 1
+		}
+		fail[i] = k
+	}
+
+	mIdx := 0
+	for mIdx < len(match) {
+		b, err := fin.ReadByte()
+		if err != nil {
+			// TODO Display how much didn't match
+			return err
+		}
+		if skipped != nil {
+			*skipped = append(*skipped, b)
+		}
+		for mIdx > 0 && b != match[mIdx] {
+			// Wrong character, fall back to the partial match that is still possible
+			mIdx = fail[mIdx-1]
+		}
+		if b == match[mIdx] {
+			mIdx = mIdx + 1
+		}
+	}
+	if skipped != nil {
+		*skipped = (*skipped)[:len(*skipped)-len(match)]
+	}
+	return nil
+}
+
+/* readInt reads a number of ASCII digits and returns them as an int */
+func readInt(fin *bufio.Reader, n int) (int, error) {
+	buf := make([]byte, n)
+	nRead, err := io.ReadFull(fin, buf)
+	if err != nil {
+		return 0, err
+	}
+	if nRead != n {
+		return 0, fmt.Errorf("ERROR: readInt only read %d byte, not %d as expected", nRead, n)
+	}
+	value, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return 0, err
+	}
+
+	return value, nil
+}
+
+/* readIntUntil reads a number of up to maxNumberDigits digits, skipping the spaces in front of it, up to the first character that is not a digit, a space after it is read as well */
+func readIntUntil(fin *bufio.Reader) (int, error) {
+	var digits []byte
+	var tooLong bool
+	for {
+		b, err := fin.ReadByte()
+		if err == io.EOF && len(digits) > 0 {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if (b >= '0' && b <= '9') || (b == '-' && len(digits) == 0) {
+			if len(digits) == maxNumberDigits {
+				// Skip the rest of the number so it is not read as text
+				tooLong = true
+				continue
+			}
+			digits = append(digits, b)
+		} else if b != ' ' || len(digits) > 0 {
+			if b != ' ' {
+				// Leave the control code or text to be parsed next
+				fin.UnreadByte()
+			}
+			break
+		}
+	}
+	if len(digits) == 0 {
+		return 0, fmt.Errorf("ERROR: readIntUntil did not find a number")
+	}
+	if tooLong {
+		return 0, fmt.Errorf("ERROR: readIntUntil found a number longer than %d digits", maxNumberDigits)
+	}
+	return strconv.Atoi(string(digits))
+}
+
+/* numberFollows returns true when the next n bytes start with the number a control code takes, after any spaces */
+func numberFollows(fin *bufio.Reader, n int) bool {
+	buf, _ := fin.Peek(n)
+	digits := bytes.TrimLeft(buf, " ")
+	return len(digits) > 0 && ((digits[0] >= '0' && digits[0] <= '9') || digits[0] == '-')
+}
+
+/* readShortInt reads a 2 byte number, short is true when it was only a digit followed by a control code */
+func readShortInt(fin *bufio.Reader) (value int, short bool, err error) {
+	buf, err := fin.Peek(2)
+	if err != nil || buf[1] >= 0x20 {
+		value, err = readInt(fin, 2)
+		return value, false, err
+	}
+	// Only 1 digit, leave the control code to be parsed next
+	value, err = readInt(fin, 1)
+	return value, true, err
+}
+
+/* readString reads characters until it hits a terminator byte, when it does not find one the characters read before the error are returned with it */
+func readString(fin *bufio.Reader, terminate byte) ([]byte, error) {
+	buf := make([]byte, 0, 80)
+	mBuff := make([]byte, 1)
+	for {
+		n, err := io.ReadFull(fin, mBuff)
+		if err != nil {
+			return buf, fmt.Errorf("ERROR: readString did not find the 0x%02x at the end of %q: %w", terminate, buf, err)
+		}
+		if n != 1 {
+			return buf, fmt.Errorf("ERROR: readString only read %d byte, not 1 as expected", n)
+		}
+		if mBuff[0] == terminate {
+			break
+		}
+		if len(buf) == maxStringLen {
+			return buf, fmt.Errorf("ERROR: readString did not find the end in %d bytes", maxStringLen)
+		}
+		buf = append(buf, mBuff[0])
+	}
+	return buf, nil
+}
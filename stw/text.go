@@ -0,0 +1,574 @@
+package stw
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Page size used by the print format when the document does not set it
+const (
+	printPageLength = 66
+	printPageWidth  = 80
+)
+
+// textRenderer - Writes the line oriented formats, text, print, ansi, speech, troff and markdown
+type textRenderer struct {
+	p        *Parser
+	format   string
+	out      *bufio.Writer
+	settings *Settings
+
+	atLineStart    bool // Nothing has been written to the current output line
+	headingPending bool // The next text starts a section heading
+	headingLine    bool // The current output line is a markdown heading
+	wroteText      bool // Text has been written, so blank lines are no longer leading
+	leadingLines   int
+	pages          int // Pages that have been finished
+	pageLines      int // Lines written on the current page
+	pageHasText    bool
+	lineNum        int         // Output line number
+	wordLen        int         // Length of the word being written
+	longestWord    int         // Longest word on the current output line
+	wideLines      []int       // Output lines with a word wider than the margins
+	emphasis       string      // The markdown emphasis that is open
+	spaces         int         // Spaces held back until the markdown emphasis is closed or continues
+	line           []byte      // Text of the current line, held back to be laid out by ApplyMargins
+	runs           []layoutRun // Font changes in the line held back for ansi
+	nextRun        int         // The first of the runs that has not been written
+	indent         string      // Indentation of the line being held back
+	blankLines     int         // Blank lines written since the last line of text
+	secondColumn   bool        // The text is being laid out in the second column of the page
+	columnPending  bool        // The second column has started, it is marked when text is written in it
+	firstLine      bool        // The next line laid out is the first line of a paragraph
+	outline        []int       // Count of the headings at each section level, for NumberHeadings
+}
+
+/* newTextRenderer returns a renderer for the Parser's line oriented format, the print format is text with every page setting applied */
+func newTextRenderer(p *Parser, w *bufio.Writer, settings *Settings) *textRenderer {
+	if p.format() == "print" {
+		printer := *p
+		printer.ApplyMargins = true
+		printer.ApplySpacing = true
+		printer.PageHeaders = true
+		printer.ContinuousPages = false
+		p = &printer
+	}
+	if p.SplitPage != nil {
+		// Parse breaks the pages, and each one needs its header and footer
+		split := *p
+		split.ContinuousPages = true
+		split.PageHeaders = true
+		p = &split
+	}
+	return &textRenderer{
+		p:           p,
+		format:      p.format(),
+		out:         w,
+		settings:    settings,
+		atLineStart: true,
+		lineNum:     1,
+		firstLine:   true,
+	}
+}
+
+/* plain returns true for the formats that are written as plain lines of text */
+func (r *textRenderer) plain() bool {
+	return r.format == "text" || r.format == "print" || r.format == "ansi"
+}
+
+/* layout returns true when the lines are held back to be laid out within the margins */
+func (r *textRenderer) layout() bool {
+	return r.p.ApplyMargins && r.plain()
+}
+
+/* bodyLines returns the lines of text that fit on a page, the print format uses a 66 line page when the document does not set its page length */
+func (r *textRenderer) bodyLines() int {
+	settings := r.settings
+	reserved := r.p.HeaderLines + r.p.FooterLines
+	if r.format == "print" && settings.PageLength <= 0 {
+		if lines := printPageLength - settings.MarginTop - settings.MarginBottom - reserved; lines > 0 {
+			return lines
+		}
+		return 0
+	}
+	return settings.bodyLines(reserved)
+}
+
+/* columns returns true when ApplyMargins lays the pages out in the two columns set by Ctrl-M and Ctrl-N, unless MergeColumns reflows them into one */
+func (r *textRenderer) columns() bool {
+	settings := r.settings
+	return r.layout() && !r.p.MergeColumns && !r.p.ContinuousPages && r.bodyLines() > 0 && settings.MarginRight2 > settings.MarginLeft2
+}
+
+/* margins returns the left and right margins of the column being laid out, the print format uses an 80 column page when the document does not set its right margin */
+func (r *textRenderer) margins() (int, int) {
+	if r.secondColumn {
+		return r.settings.MarginLeft2, r.settings.MarginRight2
+	}
+	if r.format == "print" && r.settings.MarginRight <= r.settings.MarginLeft {
+		return r.settings.MarginLeft, printPageWidth
+	}
+	return r.settings.MarginLeft, r.settings.MarginRight
+}
+
+/* marginLines writes the lines of the top or bottom margin for the print format, with the header on the first line of the top margin or the footer on the last line of the bottom one */
+func (r *textRenderer) marginLines(text []byte, lines int, top bool) {
+	if len(text) > 0 && lines < 1 {
+		// There is no margin, so the header or footer takes a line of the page
+		lines = 1
+	}
+	for i := 0; i < lines; i++ {
+		if (top && i == 0) || (!top && i == lines-1) {
+			if len(text) > 0 {
+				r.out.WriteString(strings.Repeat(" ", r.settings.MarginLeft))
+				r.out.Write(text)
+			}
+		}
+		r.out.WriteByte('\n')
+	}
+}
+
+/* startPage marks the start of the second column, then records the header of the page when the first text is written on it, and prints it when asked to, on the first of the HeaderLines when they are kept for it */
+func (r *textRenderer) startPage() {
+	if r.columnPending {
+		r.out.WriteString("--- Column 2 ---\n")
+		r.columnPending = false
+	}
+	if r.pageHasText {
+		return
+	}
+	page := strconv.Itoa(r.settings.pageNumber(r.pages))
+	header := pageText(r.settings.Header, page)
+	if r.p.HeaderIndex != nil {
+		fmt.Fprintf(r.p.HeaderIndex, "Page %s\t%s\n", page, reportString(header))
+	}
+	if r.format == "print" && r.p.HeaderLines > 0 {
+		r.marginLines(nil, r.settings.MarginTop, true)
+		r.marginLines(header, r.p.HeaderLines, true)
+	} else if r.format == "print" {
+		r.marginLines(header, r.settings.MarginTop, true)
+	} else if r.p.PageHeaders && r.p.HeaderLines > 0 && r.plain() {
+		// The header is on the first of the lines kept for it
+		r.out.Write(header)
+		r.out.WriteString(strings.Repeat("\n", r.p.HeaderLines))
+	} else if r.p.PageHeaders && len(header) > 0 && r.plain() {
+		// Headers are printed in the top margin, so they are not counted
+		r.out.Write(header)
+		r.out.WriteString("\n\n")
+	}
+	r.pageHasText = true
+}
+
+/* endPage prints the footer at the bottom of a page with text on it when asked to, on the last of the FooterLines when they are kept for it, the print format fills out the page and its bottom margin */
+func (r *textRenderer) endPage() {
+	footer := pageText(r.settings.Footer, strconv.Itoa(r.settings.pageNumber(r.pages)))
+	if r.format == "print" {
+		if r.pageHasText {
+			for r.pageLines < r.bodyLines() {
+				r.out.WriteByte('\n')
+				r.pageLines = r.pageLines + 1
+			}
+			if r.p.FooterLines > 0 {
+				r.marginLines(footer, r.p.FooterLines, false)
+				r.marginLines(nil, r.settings.MarginBottom, false)
+			} else {
+				r.marginLines(footer, r.settings.MarginBottom, false)
+			}
+		}
+		return
+	}
+	if r.p.PageHeaders && r.pageHasText && r.p.FooterLines > 0 && r.plain() {
+		if !r.atLineStart {
+			// The last line of the document has no line end
+			r.out.WriteString("\n")
+		}
+		// The footer is on the last of the lines kept for it
+		r.out.WriteString(strings.Repeat("\n", r.p.FooterLines-1))
+		r.out.Write(footer)
+		r.out.WriteString("\n")
+	} else if r.p.PageHeaders && r.pageHasText && len(footer) > 0 && r.plain() {
+		if !r.atLineStart {
+			// The last line of the document has no line end
+			r.out.WriteString("\n")
+		}
+		r.out.WriteString("\n")
+		r.out.Write(footer)
+		r.out.WriteString("\n")
+	}
+}
+
+/* write writes text to the output, or holds it back with the rest of the line for layout */
+func (r *textRenderer) write(text []byte) {
+	if r.layout() {
+		r.line = append(r.line, text...)
+	} else {
+		r.out.Write(text)
+	}
+}
+
+/* startLine writes the indentation when text begins a new output line */
+func (r *textRenderer) startLine() {
+	settings := r.settings
+	r.startPage()
+	if r.atLineStart && r.plain() {
+		indent := ""
+		if r.p.SectionIndent > 0 && settings.SectionLevel > 0 {
+			indent = strings.Repeat(" ", settings.SectionLevel*r.p.SectionIndent)
+		}
+		if r.layout() {
+			// The margin is added when the line is laid out
+			r.indent = indent
+		} else {
+			r.out.WriteString(indent)
+		}
+	}
+	if r.atLineStart && r.format == "troff" {
+		if settings.BlockRight {
+			r.out.WriteString(".rj\n")
+		} else if settings.Center {
+			r.out.WriteString(".ce\n")
+		}
+	}
+	if r.headingPending {
+		switch r.format {
+		case "speech":
+			fmt.Fprintf(r.out, "Heading level %d: ", settings.SectionLevel)
+		case "troff":
+			if settings.SectionLevel <= 1 {
+				r.out.WriteString(".SH ")
+			} else {
+				r.out.WriteString(".SS ")
+			}
+		case "markdown":
+			r.out.WriteString(markdownHeading(settings.SectionLevel))
+			r.headingLine = true
+		case "text", "print", "ansi":
+			r.write([]byte(r.outlineNumber(settings.SectionLevel) + " "))
+		}
+		r.headingPending = false
+	}
+	r.atLineStart = false
+	r.wroteText = true
+}
+
+/* spaced returns true when blank lines are added for the line and paragraph spacing */
+func (r *textRenderer) spaced() bool {
+	return r.p.ApplySpacing && r.plain()
+}
+
+/* spacingLines returns the number of blank lines to write after each line */
+func (r *textRenderer) spacingLines() int {
+	if !r.spaced() {
+		return 0
+	}
+	return r.settings.lineSpacing() - 1
+}
+
+/* newLine ends the current output line, followed by the blank lines for the line spacing */
+func (r *textRenderer) newLine() {
+	r.endLine(r.spacingLines())
+}
+
+/* endLine ends the current output line followed by blank lines, dropping leading blank lines when asked to */
+func (r *textRenderer) endLine(blank int) {
+	if !r.wroteText {
+		r.leadingLines = r.leadingLines + 1
+		if r.p.LeadingBlankLines == "strip" || (r.p.LeadingBlankLines == "strip-one" && r.leadingLines == 1) {
+			return
+		}
+	}
+	r.closeEmphasis()
+	if r.layout() {
+		r.writeLayout()
+	}
+	r.lineFeed(blank)
+}
+
+/* lineFeed ends an output line and writes blank lines after it, leaving out the ones at the top of a new page */
+func (r *textRenderer) lineFeed(blank int) {
+	r.countLine()
+	for i := 0; i < blank && r.pageLines > 0; i++ {
+		r.countLine()
+	}
+}
+
+/* countLine ends an output line and counts it on the page, breaking the page when it is full */
+func (r *textRenderer) countLine() {
+	if r.atLineStart {
+		r.blankLines = r.blankLines + 1
+	} else {
+		r.blankLines = 0
+	}
+	if r.format == "print" {
+		// Blank lines at the top of the page come after its top margin
+		r.startPage()
+	}
+	r.out.WriteByte('\n')
+	r.atLineStart = true
+	r.headingLine = false
+
+	left, right := r.margins()
+	width := right - left
+	if r.p.CheckLineWidth && width > 0 && r.longestWord > width {
+		r.wideLines = append(r.wideLines, r.lineNum)
+	}
+	r.lineNum = r.lineNum + 1
+	r.wordLen = 0
+	r.longestWord = 0
+
+	r.pageLines = r.pageLines + 1
+	bodyLines := r.bodyLines()
+	paginate := r.plain() || r.format == "speech" || r.p.PageMarkers || r.p.HeaderIndex != nil
+	if r.p.ContinuousPages {
+		paginate = false
+	}
+	if paginate && bodyLines > 0 && r.pageLines >= bodyLines {
+		if r.columns() && !r.secondColumn {
+			r.columnBreak()
+		} else {
+			r.pageBreak()
+		}
+	}
+}
+
+/* columnBreak moves on to the second column when the first one has filled the page, it is written after the first one */
+func (r *textRenderer) columnBreak() {
+	r.secondColumn = true
+	r.columnPending = true
+	r.pageLines = 0
+}
+
+/* pageBreak starts a new page, with a form feed or the rest of the page padded out when asked to, and marks it */
+func (r *textRenderer) pageBreak() {
+	if !r.atLineStart {
+		finished := r.pages
+		r.newLine()
+		if r.pages != finished {
+			// Ending the line filled the page
+			return
+		}
+	}
+	if r.p.FormFeed == "pad" && r.plain() {
+		for r.pageLines < r.bodyLines() {
+			r.out.WriteByte('\n')
+			r.pageLines = r.pageLines + 1
+		}
+	}
+	r.endPage()
+	r.pages = r.pages + 1
+	r.pageLines = 0
+	r.secondColumn = false
+	r.columnPending = false
+	r.pageHasText = false
+	if r.p.FormFeed == "ff" && r.plain() {
+		r.out.WriteByte('\f')
+	}
+	if r.format == "speech" {
+		fmt.Fprintf(r.out, "Page %d,\n", r.settings.pageNumber(r.pages))
+		r.wroteText = true
+	} else if r.format == "troff" {
+		r.out.WriteString(".bp\n")
+	} else if r.p.PageMarkers {
+		fmt.Fprintf(r.out, "--- Page %d ---\n", r.settings.pageNumber(r.pages))
+		r.wroteText = true
+	}
+	if r.p.FlushInterval == "page" || r.p.FlushInterval == "paragraph" {
+		r.out.Flush()
+	}
+}
+
+/* closeEmphasis ends the open markdown emphasis, then writes the spaces held back inside it */
+func (r *textRenderer) closeEmphasis() {
+	if len(r.emphasis) > 0 {
+		r.out.WriteString(r.emphasis)
+		r.emphasis = ""
+	}
+	if r.spaces > 0 {
+		r.out.WriteString(strings.Repeat(" ", r.spaces))
+		r.spaces = 0
+	}
+}
+
+/* markdownText writes text, opening the emphasis for the current font at the first character that is not a space */
+func (r *textRenderer) markdownText(text []byte, lineStart bool) {
+	for i, b := range text {
+		if b == ' ' && len(r.emphasis) > 0 {
+			// Markdown does not end emphasis that has a space before the closing marker
+			r.spaces = r.spaces + 1
+			continue
+		}
+		if b != ' ' {
+			if emphasis := markdownEmphasis(r.settings.Font); emphasis != r.emphasis {
+				r.closeEmphasis()
+				r.out.WriteString(emphasis)
+				r.emphasis = emphasis
+			}
+		}
+		if r.spaces > 0 {
+			r.out.WriteString(strings.Repeat(" ", r.spaces))
+			r.spaces = 0
+		}
+		r.out.Write(markdownEscape(b, lineStart && i == 0))
+	}
+}
+
+/* startDocument resets the page counts at the start of each document, the outline carries on into the pages from SplitPage */
+func (r *textRenderer) startDocument(documents, pages int) {
+	r.headingPending = false
+	r.pages = pages
+	r.pageLines = 0
+	r.pageHasText = false
+	r.secondColumn = false
+	r.columnPending = false
+	r.firstLine = true
+	if pages == 0 {
+		r.outline = r.outline[:0]
+	}
+	if documents > 1 {
+		fmt.Fprintf(r.out, "\n--- Document %d ---\n\n", documents)
+	}
+}
+
+/* text writes printable text, escaping it for the output format */
+func (r *textRenderer) text(text []byte) {
+	lineStart := r.atLineStart && !r.headingPending
+	r.startLine()
+	switch r.format {
+	case "troff":
+		r.out.Write(troffEscape(text, lineStart))
+	case "markdown":
+		r.markdownText(text, lineStart)
+	default:
+		r.write(text)
+	}
+	for _, c := range string(text) {
+		if c == ' ' {
+			r.wordLen = 0
+		} else {
+			r.wordLen = r.wordLen + 1
+			if r.wordLen > r.longestWord {
+				r.longestWord = r.wordLen
+			}
+		}
+	}
+}
+
+/* lineEnd ends the output line, markdown needs a hard break to keep the lines apart */
+func (r *textRenderer) lineEnd() {
+	if r.format == "markdown" && !r.atLineStart && !r.headingLine {
+		r.closeEmphasis()
+		r.out.WriteString("  ")
+	}
+	r.newLine()
+}
+
+/* paragraph ends the paragraph with a blank line, or the paragraph spacing when ApplySpacing is set */
+func (r *textRenderer) paragraph() {
+	if r.format == "troff" {
+		if !r.atLineStart {
+			r.newLine()
+		}
+		r.out.WriteString(".PP\n")
+	} else if r.spaced() {
+		// The paragraph spacing takes the place of the line spacing after the last line
+		if !r.atLineStart {
+			r.endLine(r.settings.paragraphSpacing())
+		}
+		for i := r.blankLines; i < r.settings.paragraphSpacing() && r.pageLines > 0; i++ {
+			r.endLine(0)
+		}
+	} else {
+		r.newLine()
+		r.newLine()
+	}
+	r.firstLine = true
+}
+
+/* pageEject starts a new page */
+func (r *textRenderer) pageEject() {
+	r.pageBreak()
+}
+
+/* fontChange switches troff and ansi to the new font, markdown opens the emphasis with the next text */
+func (r *textRenderer) fontChange() {
+	switch r.format {
+	case "troff":
+		r.out.WriteString(troffFont(r.settings.Font))
+	case "ansi":
+		if r.layout() {
+			// The escape code takes no room, it is written where the line is laid out
+			r.runs = append(r.runs, layoutRun{offset: len(r.line), font: r.settings.Font})
+		} else {
+			r.out.WriteString(ansiFont(r.settings.Font))
+		}
+	}
+}
+
+/* heading starts a new line for the formats that mark headings at the start of a line */
+func (r *textRenderer) heading() {
+	numbered := r.p.NumberHeadings && r.plain() && r.settings.SectionLevel > 0
+	r.headingPending = r.format == "speech" || r.format == "troff" || r.format == "markdown" || numbered
+	if (r.format == "troff" || r.format == "markdown" || numbered) && !r.atLineStart {
+		r.newLine()
+	}
+}
+
+/* outlineNumber counts a heading at level and returns its outline number, the deeper levels start again from 1 */
+func (r *textRenderer) outlineNumber(level int) string {
+	for len(r.outline) < level {
+		r.outline = append(r.outline, 0)
+	}
+	r.outline = r.outline[:level]
+	r.outline[level-1] = r.outline[level-1] + 1
+	numbers := make([]string, level)
+	for i, n := range r.outline {
+		numbers[i] = strconv.Itoa(n)
+	}
+	return strings.Join(numbers, ".")
+}
+
+/* comment marks the rest of the line as a comment */
+func (r *textRenderer) comment() {
+	if r.format == "troff" {
+		if r.atLineStart {
+			r.out.WriteString(`.\" `)
+		} else {
+			r.out.WriteString(`\" `)
+		}
+		r.atLineStart = false
+		return
+	}
+	r.startLine()
+	r.write([]byte("COMMENT: "))
+}
+
+/* header is printed at the top of each page by PageHeaders */
+func (r *textRenderer) header() {
+}
+
+/* footer is printed at the bottom of each page by PageHeaders */
+func (r *textRenderer) footer() {
+}
+
+/* endDocument finishes the last line and page, and warns about the lines that were too wide */
+func (r *textRenderer) endDocument(more bool) {
+	if (more || r.format == "print") && !r.atLineStart {
+		r.newLine()
+	} else if r.layout() && !r.atLineStart {
+		// The last line has no line end
+		r.writeLayout()
+	}
+	r.closeEmphasis()
+	if r.format == "ansi" && r.settings.Font != PicaFont {
+		// Do not leave the terminal in the last font
+		r.out.WriteString(ansiReset)
+	}
+	r.endPage()
+	r.out.Flush()
+	if len(r.wideLines) > 0 {
+		r.p.warning(r.settings, newWarning(-1, 0, fmt.Errorf("WARNING: %d lines have words wider than the margins: %s", len(r.wideLines), joinInts(r.wideLines))))
+		r.wideLines = nil
+	}
+}
@@ -0,0 +1,58 @@
+package stw
+
+import (
+	"fmt"
+)
+
+// traceArgsSize is how many bytes after a control code are kept for the trace
+const traceArgsSize = 16
+
+// codeNames - The names of the control codes in the trace
+var codeNames = map[byte]string{
+	0x00: "Line End",
+	0x02: "Bottom Margin",
+	0x03: "Center",
+	0x04: "Paragraph Spacing",
+	0x05: "Page Eject",
+	0x06: "Footer",
+	0x07: "Font Change",
+	0x08: "Header",
+	0x09: "Paragraph Indent",
+	0x0a: "Justification",
+	0x0b: "Comment",
+	0x0c: "Left Margin",
+	0x0d: "Column2 Left Margin",
+	0x0e: "Column2 Right Margin",
+	0x0f: "Printer Code",
+	0x10: "Paragraph",
+	0x11: "Starting Page",
+	0x12: "Right Margin",
+	0x13: "Line Spacing",
+	0x14: "Top Margin",
+	0x15: "Section Heading",
+	0x16: "Chain File",
+	0x17: "Page Wait",
+	0x18: "Printer Codes",
+	0x19: "Lines Per Page",
+}
+
+/* codeName returns the key and name of a control code, eg. Ctrl-G Font Change, or Unprintable for the other bytes */
+func codeName(code byte) string {
+	if code >= 0x20 {
+		return "Unprintable"
+	}
+	name, ok := codeNames[code]
+	if !ok {
+		name = "Unknown"
+	}
+	return fmt.Sprintf("Ctrl-%c %s", '@'+code, name)
+}
+
+/* trace writes a line about a control code to the Parser's Trace, args are the bytes read after it, a font change is followed by the name of the font */
+func (p *Parser) trace(offset int64, code byte, args []byte, value int) {
+	if code == 0x07 {
+		fmt.Fprintf(p.Trace, "%08X 0x%02x %-26s %q %s\n", offset, code, codeName(code), args, FontType(value))
+		return
+	}
+	fmt.Fprintf(p.Trace, "%08X 0x%02x %-26s %q\n", offset, code, codeName(code), args)
+}
@@ -0,0 +1,28 @@
+package stw
+
+/* troffFont returns the troff font escape for a STWriter font */
+func troffFont(font FontType) string {
+	switch font {
+	case BoldFont:
+		return `\fB`
+	case ItalicFont:
+		return `\fI`
+	}
+	return `\fR`
+}
+
+/* troffEscape escapes backslashes, and a leading . or ' that troff would read as a request */
+func troffEscape(text []byte, lineStart bool) []byte {
+	var escaped []byte
+	if lineStart && len(text) > 0 && (text[0] == '.' || text[0] == '\'') {
+		escaped = append(escaped, `\&`...)
+	}
+	for _, b := range text {
+		if b == '\\' {
+			escaped = append(escaped, `\e`...)
+		} else {
+			escaped = append(escaped, b)
+		}
+	}
+	return escaped
+}